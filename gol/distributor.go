@@ -1,54 +1,55 @@
 package gol
 
 import (
+	"encoding/gob"
 	"fmt"
+	"io"
+	"net"
 	"net/rpc"
 	"strconv"
-	"time"
+	"sync"
 
 	"uk.ac.bris.cs/gameoflife/stubs"
 	"uk.ac.bris.cs/gameoflife/util"
 )
 
 type distributorChannels struct {
-	events     chan<- Event
-	ioCommand  chan<- ioCommand
-	ioIdle     <-chan bool
-	ioFilename chan<- string
-	ioOutput   chan<- uint8
-	ioInput    <-chan uint8
+	events       chan<- Event
+	ioCommand    chan<- ioCommand
+	ioIdle       <-chan bool
+	ioFilename   chan<- string
+	ioOutput     chan<- uint8
+	ioInput      <-chan uint8
+	ioInputError <-chan error
 }
 
-func makeMatrix(height, width int) [][]uint8 {
-	matrix := make([][]uint8, height)
-	for i := range matrix {
-		matrix[i] = make([]uint8, width)
-	}
-	return matrix
-}
-
-func readPgmData(p Params, c distributorChannels, world [][]uint8) [][]uint8 {
+// The world is only unpacked from bits at the PGM boundary, a byte per cell is what the io goroutine deals in
+func readPgmData(p Params, c distributorChannels) (util.BitBoard, error) {
+	world := util.NewBitBoard(p.ImageWidth, p.ImageHeight)
 	c.ioCommand <- ioInput
 	c.ioFilename <- strconv.Itoa(p.ImageWidth) + "x" + strconv.Itoa(p.ImageHeight)
+	if err := <-c.ioInputError; err != nil {
+		return world, err
+	}
 	for col := 0; col < p.ImageHeight; col++ {
 		for row := 0; row < p.ImageWidth; row++ {
 			data := <-c.ioInput
-			world[col][row] = data
 			if data == 255 {
+				world.Set(row, col, true)
 				c.events <- CellFlipped{0, util.Cell{X: row, Y: col}}
 			}
 		}
 	}
-	return world
+	return world, nil
 }
 
-func writePgmData(p Params, c distributorChannels, world [][]uint8, turn int) {
+func writePgmData(p Params, c distributorChannels, world util.BitBoard, turn int) {
 	filename := strconv.Itoa(p.ImageWidth) + "x" + strconv.Itoa(p.ImageHeight) + "x" + strconv.Itoa(turn)
 	c.ioCommand <- ioOutput
 	c.ioFilename <- filename
 	for col := 0; col < p.ImageHeight; col++ {
 		for row := 0; row < p.ImageWidth; row++ {
-			if world[col][row] == 255 {
+			if world.Alive(row, col) {
 				c.ioOutput <- 255
 			} else {
 				c.ioOutput <- 0
@@ -58,171 +59,389 @@ func writePgmData(p Params, c distributorChannels, world [][]uint8, turn int) {
 	c.events <- ImageOutputComplete{turn, filename}
 }
 
-func findAliveCells(p Params, world [][]uint8) []util.Cell {
-	var alive []util.Cell
+// writeFrame sends the world to the io goroutine as the next frame of the game's animation.
+func writeFrame(p Params, c distributorChannels, world util.BitBoard) {
+	c.ioCommand <- ioFrame
+	c.ioFilename <- strconv.Itoa(p.ImageWidth) + "x" + strconv.Itoa(p.ImageHeight)
 	for col := 0; col < p.ImageHeight; col++ {
 		for row := 0; row < p.ImageWidth; row++ {
-			if world[col][row] == 255 {
-				alive = append(alive, util.Cell{X: row, Y: col})
+			if world.Alive(row, col) {
+				c.ioOutput <- 255
+			} else {
+				c.ioOutput <- 0
 			}
 		}
 	}
-	return alive
 }
 
-func timer(client *rpc.Client, c distributorChannels, finish *bool) {
-	ticker := time.NewTicker(2 * time.Second)
-	for {
-		<-ticker.C
-		if !(*finish) {
-			turn, aliveCellCount := callTurnAndWorld(client)
-			//fmt.Println(turn, aliveCellCount)
-			c.events <- AliveCellsCount{turn, aliveCellCount}
-		} else {
-			break
-		}
-	}
-	return
-}
-
-func saveWorld(p Params, c distributorChannels, client *rpc.Client) {
-	turn, _ := callTurnAndWorld(client)
-	world := callWorld(client)
+func saveWorld(p Params, c distributorChannels, client *rpc.Client, game int) {
+	turn, _ := callTurnAndWorld(client, game)
+	world := callWorld(client, game)
 	writePgmData(p, c, world, turn)
 }
 
-func stateChange(client *rpc.Client, c distributorChannels, newState State) {
-	turn, _ := callTurnAndWorld(client)
-	c.events <- StateChange{turn, newState}
+func sendAliveCells(p Params, c distributorChannels, world util.BitBoard, turn int) {
+	for _, cell := range world.AliveCells(0) {
+		c.events <- CellFlipped{turn, cell}
+	}
 }
 
-func keyPressesFunc(p Params, c distributorChannels, client *rpc.Client, keyPresses <-chan rune) {
+// keyPressesFunc carries out the keys pressed. The StateChange events for pausing and resuming come down the stream.
+func keyPressesFunc(p Params, c distributorChannels, client *rpc.Client, keyPresses <-chan rune, game stubs.AttachResponse, done <-chan bool, detached chan<- bool, helpers *sync.WaitGroup) {
+	defer helpers.Done()
+	controller := stubs.ControllerRequest{Game: game.Game, Controller: game.Controller}
+	paused := game.Paused
+	steps := 0
 	for {
 		select {
 		case key := <-keyPresses:
+			if key >= '0' && key <= '9' {
+				steps = steps*10 + int(key-'0')
+				continue
+			}
+			if p.Observe && key != 'q' {
+				fmt.Println("Only the controller can pause, step, save or kill the game, this client is observing")
+				steps = 0
+				continue
+			}
 			if key == 's' {
-				saveWorld(p, c, client)
+				saveWorld(p, c, client, game.Game)
 			}
 			if key == 'q' {
+				// The broker carries on with the game, starting the client again with -game attaches to it
 				fmt.Println("Closing Client...")
-				err := client.Call(stubs.Reset, stubs.EmptyRequest{}, &stubs.EmptyResponse{})
+				if !p.Observe {
+					fmt.Printf("Game %d carries on, attach to it again with -game %d\n", game.Game, game.Game)
+				}
+				err := client.Call(stubs.Detach, controller, &stubs.EmptyResponse{})
 				if err != nil {
 					fmt.Println(err.Error())
 				}
+				close(detached)
+				return
 			}
 			if key == 'k' {
-				saveWorld(p, c, client)
-				stateChange(client, c, Quitting)
-				err := client.Call(stubs.Shutdown, stubs.EmptyRequest{}, &stubs.EmptyResponse{})
+				// The broker stops the game and replies to CompleteTurn, which saves the final image
+				err := client.Call(stubs.Shutdown, controller, &stubs.EmptyResponse{})
 				if err != nil {
 					fmt.Println(err.Error())
 				}
-
+				return
 			}
 			if key == 'p' {
-				fmt.Println("Pressed P")
-				callPauseAndResume(client, stubs.PauseRequest{Command: "PAUSE"})
-				stateChange(client, c, Paused)
-				for {
-					await := <-keyPresses
-					if await == 'p' {
-						callPauseAndResume(client, stubs.PauseRequest{Command: "RESUME"})
-						stateChange(client, c, Executing)
-						break
-					}
+				if paused {
+					callPauseAndResume(client, stubs.PauseRequest{Game: game.Game, Controller: game.Controller, Command: "RESUME"})
+				} else {
+					fmt.Println("Pressed P")
+					callPauseAndResume(client, stubs.PauseRequest{Game: game.Game, Controller: game.Controller, Command: "PAUSE"})
+				}
+				paused = !paused
+			}
+			if key == 'n' {
+				// Steps one turn, or as many as the digits typed before it say
+				if steps == 0 {
+					steps = 1
+				}
+				if paused {
+					turn := callPauseAndResume(client, stubs.PauseRequest{Game: game.Game, Controller: game.Controller, Command: "STEP", Turns: steps})
+					fmt.Println("Stepping to turn", turn)
+				} else {
+					fmt.Println("Pause with p before stepping")
+				}
+			}
+			steps = 0
+		case cell := <-CellEdits:
+			if !paused || p.Observe {
+				break
+			}
+			// A drag sends cells faster than the broker takes them, so they go in batches
+			cells := []util.Cell{cell}
+			for more := true; more; {
+				select {
+				case cell := <-CellEdits:
+					cells = append(cells, cell)
+				default:
+					more = false
 				}
 			}
+			editCells(client, game, cells)
+		case <-done:
+			return
 		}
 	}
 }
 
-func sdlHandler(p Params, c distributorChannels, client *rpc.Client) {
+// editCells flips cells in the paused game, the broker sends the flipped cells down the stream like a turn's
+func editCells(client *rpc.Client, game stubs.AttachResponse, cells []util.Cell) {
+	err := client.Call(stubs.EditCells, stubs.CellsRequest{Game: game.Game, Controller: game.Controller, Cells: cells}, new(stubs.PauseResponse))
+	if err != nil {
+		fmt.Println(err)
+	}
+}
 
-	for i := 0; i < p.Turns; i++ {
-		response := new(stubs.SdlResponse)
-		err := client.Call(stubs.GetWorldPerTurn, stubs.EmptyRequest{}, response)
-		if err != nil {
-			fmt.Println(err)
-		}
+// openStream connects to the broker's stream for the controller or observer, and waits for the broker to say the
+// stream is hooked up to the game so no turns are missed.
+func openStream(game stubs.AttachResponse) (net.Conn, *gob.Decoder, error) {
+	host, _, err := net.SplitHostPort(Server)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, game.Stream))
+	if err != nil {
+		return nil, nil, err
+	}
+	decoder := gob.NewDecoder(conn)
+	var message stubs.StreamMessage
+	err = gob.NewEncoder(conn).Encode(stubs.StreamRequest{Game: game.Game, Controller: game.Controller})
+	if err == nil {
+		err = decoder.Decode(&message)
+	}
+	if err == nil && message.Kind != stubs.SubscribedMessage {
+		err = fmt.Errorf("stream opened with a %s message", message.Kind)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, decoder, nil
+}
 
-		for _, flippedCells := range response.FlippedCells {
-			c.events <- CellFlipped{CompletedTurns: response.Turn, Cell: flippedCells}
+// sdlHandler turns what the broker pushes down the stream into events until the stream is closed, which it is
+// once the game ends or the controller detaches. It keeps its own copy of the world up to date with the flipped
+// cells, so when so many have flipped that the broker sends the whole world it can work out which did, and so
+// every Nth turn can be added to the animation. A sampled stream skips turns, so animation frames are written
+// for the first turn at or past each multiple of p.FrameEvery. Only the controller writes the animation, an observer
+// writing it too would clash with it like the final image.
+func sdlHandler(p Params, c distributorChannels, stream *gob.Decoder, startTurn int, world util.BitBoard, sdlDone chan<- bool) {
+	defer close(sdlDone)
+
+	animate := p.FrameEvery > 0 && !p.Observe
+	if animate && startTurn%p.FrameEvery == 0 {
+		writeFrame(p, c, world)
+	}
+	turn := startTurn
+	for {
+		var message stubs.StreamMessage
+		if err := stream.Decode(&message); err != nil {
+			if err != io.EOF {
+				fmt.Println(err)
+			}
+			return
+		}
+		switch message.Kind {
+		case stubs.TurnMessage:
+			flipped := message.FlippedCells
+			if message.World.Height > 0 {
+				flipped = message.World.Diff(world, 0)
+			}
+			for _, cell := range flipped {
+				c.events <- CellFlipped{CompletedTurns: message.Turn, Cell: cell}
+				world.Flip(cell.X, cell.Y)
+			}
+			c.events <- TurnComplete{message.Turn}
+			if animate && message.Turn/p.FrameEvery > turn/p.FrameEvery {
+				writeFrame(p, c, world)
+			}
+			turn = message.Turn
+		case stubs.AliveMessage:
+			c.events <- AliveCellsCount{message.Turn, message.Alive}
+		case stubs.StateMessage:
+			state := Executing
+			if message.Paused {
+				state = Paused
+			}
+			c.events <- StateChange{message.Turn, state}
 		}
-		c.events <- TurnComplete{response.Turn}
 	}
-	return
 }
 
 // distributor divides the work between workers and interacts with other goroutines.
 func distributor(p Params, c distributorChannels, keyPresses <-chan rune) {
 
-	brokerAddress := "localhost:8003"
-	client, _ := rpc.Dial("tcp", brokerAddress)
+	_, err := util.ParseRule(p.Rule)
+	if err == nil {
+		err = util.CheckBoundary(p.Boundary)
+	}
+	if err == nil {
+		err = CheckOutputFormat(p.OutputFormat)
+	}
+	if err == nil {
+		err = CheckAnimationFormat(p.AnimationFormat)
+	}
+	if err != nil {
+		fmt.Println(err)
+		c.events <- StateChange{0, Quitting}
+		close(c.events)
+		return
+	}
+
+	client, err := rpc.Dial("tcp", Server)
+	if err != nil {
+		fmt.Println("Could not reach the broker at", Server+":", err)
+		c.events <- StateChange{0, Quitting}
+		close(c.events)
+		return
+	}
 	defer client.Close()
 
-	initialWorld := readPgmData(p, c, makeMatrix(p.ImageHeight, p.ImageWidth))
+	game, err := callAttach(client, stubs.AttachRequest{Game: p.Game, ImageWidth: p.ImageWidth, ImageHeight: p.ImageHeight, FrameRate: p.FrameRate, Observer: p.Observe})
+	if err != nil {
+		c.events <- StateChange{0, Quitting}
+		close(c.events)
+		return
+	}
+	conn, stream, err := openStream(game)
+	if err != nil {
+		fmt.Println("Could not open the stream from the broker:", err)
+		_ = client.Call(stubs.Detach, stubs.ControllerRequest{Game: game.Game, Controller: game.Controller}, &stubs.EmptyResponse{})
+		c.events <- StateChange{0, Quitting}
+		close(c.events)
+		return
+	}
+	defer conn.Close()
+
+	gameStatus := "NEW"
+	startTurn := 0
+	var initialWorld, startWorld util.BitBoard
+	if game.Running {
+		gameStatus = "ATTACH"
+		startTurn = game.Turn
+		p.Turns = game.Turns
+		startWorld = game.World
+		sendAliveCells(p, c, game.World, startTurn)
+		if p.Observe {
+			fmt.Printf("Observing game %d on the broker from turn %d\n", game.Game, startTurn)
+		} else {
+			fmt.Printf("Attached to game %d on the broker at turn %d\n", game.Game, startTurn)
+		}
+	} else if p.Resume {
+		checkpoint, err := callCheckpoint(client, p)
+		if err == nil && checkpoint.ImageWidth == p.ImageWidth && checkpoint.ImageHeight == p.ImageHeight {
+			gameStatus = "RESUME"
+			startTurn = checkpoint.Turn
+			if checkpoint.Rule != "" {
+				p.Rule = checkpoint.Rule
+			}
+			if checkpoint.Boundary != "" {
+				p.Boundary = checkpoint.Boundary
+			}
+			startWorld = checkpoint.World
+			sendAliveCells(p, c, checkpoint.World, startTurn)
+			fmt.Println("Resuming from turn", startTurn)
+		} else {
+			fmt.Println("No checkpoint of this image to resume from, starting a new game")
+		}
+	}
+	if gameStatus == "NEW" {
+		initialWorld, err = readPgmData(p, c)
+		if err != nil {
+			fmt.Println(err)
+			_ = client.Call(stubs.Detach, stubs.ControllerRequest{Game: game.Game, Controller: game.Controller}, &stubs.EmptyResponse{})
+			c.events <- StateChange{0, Quitting}
+			close(c.events)
+			return
+		}
+		startWorld = initialWorld.Copy()
+	}
+	if game.Paused {
+		c.events <- StateChange{startTurn, Paused}
+	}
 
-	allTurnsProcessed := false
-	go timer(client, c, &allTurnsProcessed)
-	go keyPressesFunc(p, c, client, keyPresses)
-	go sdlHandler(p, c, client)
+	done := make(chan bool)
+	detached := make(chan bool)
+	sdlDone := make(chan bool)
+	var helpers sync.WaitGroup
+	helpers.Add(1)
+	go keyPressesFunc(p, c, client, keyPresses, game, done, detached, &helpers)
+	go sdlHandler(p, c, stream, startTurn, startWorld, sdlDone)
 
-	//var nodeAddresses []string
-	//for _, node := range strings.Split(Server, ",") {
-	//	nodeAddresses = append(nodeAddresses, node+":8030")
-	//}
-	//var testNodes = []string{"localhost:8000","localhost:8001","localhost:8004"}
-	//var testNodes = []string{"localhost:8000", "localhost:8001"}
-	var testNodes = []string{"localhost:8030","localhost:8031"}
-	//var testNodes = []string{"localhost:8030"}
+	if gameStatus != "ATTACH" {
+		fmt.Printf("Starting game %d on the broker\n", game.Game)
+	}
+	request := stubs.Request{Game: game.Game, Controller: game.Controller, Turns: p.Turns, Threads: p.Threads, ImageWidth: p.ImageWidth, ImageHeight: p.ImageHeight, Rule: p.Rule, Boundary: p.Boundary, GameStatus: gameStatus, InitialWorld: initialWorld}
+	response := stubs.Response{}
 
-	request := stubs.Request{Turns: p.Turns, Threads: p.Threads, ImageWidth: p.ImageHeight, ImageHeight: p.ImageWidth, GameStatus: "NEW", InitialWorld: initialWorld, Workers: testNodes}
-	response := stubs.Response{World: makeMatrix(p.ImageWidth, p.ImageHeight)}
+	isDetached := false
+	failed := false
+	call := client.Go(stubs.TurnHandler, request, &response, nil)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			fmt.Println(call.Error)
+			failed = true
+		}
+	case <-detached:
+		isDetached = true
+	}
 
-	callTurn(client, request, &response)
-	allTurnsProcessed = true
+	// Every event from the helpers has to be sent before the events channel is closed
+	<-sdlDone
+	close(done)
+	helpers.Wait()
 
-	//respone.world needs to be good
-	c.events <- FinalTurnComplete{p.Turns, findAliveCells(p, response.World)}
-	writePgmData(p, c, response.World, p.Turns) // This line needed if out/ does not have files
+	// A game that failed has no final world to show or save
+	turn := response.Turn
+	if isDetached {
+		turn, _ = callTurnAndWorld(client, game.Game)
+	} else if !failed {
+		//respone.world needs to be good
+		c.events <- FinalTurnComplete{turn, response.World.AliveCells(0)}
+		// the controller saves the final image, an observer writing it too would clash with it
+		if !p.Observe {
+			writePgmData(p, c, response.World, turn) // This line needed if out/ does not have files
+		}
+	}
 
 	// Make sure that the Io has finished any output before exiting.
 	c.ioCommand <- ioCheckIdle
 	<-c.ioIdle
 
-	c.events <- StateChange{p.Turns, Quitting}
+	c.events <- StateChange{turn, Quitting}
 
 	// Close the channel to stop the SDL goroutine gracefully. Removing may cause deadlock.
 	close(c.events)
 }
 
-func callTurn(client *rpc.Client, req stubs.Request, res *stubs.Response) {
-	err := client.Call(stubs.TurnHandler, req, res)
+func callTurnAndWorld(client *rpc.Client, game int) (int, int) {
+	turnRequest := stubs.TurnRequest{Game: game}
+	turnResponse := new(stubs.TurnResponse)
+	err := client.Call(stubs.AliveCellGetter, turnRequest, turnResponse)
 	if err != nil {
 		fmt.Println(err)
 	}
+	return turnResponse.Turn, turnResponse.NumOfAliveCells
 }
 
-func callTurnAndWorld(client *rpc.Client) (int, int) {
-	turnRequest := stubs.TurnRequest{}
-	turnResponse := new(stubs.TurnResponse)
-	err := client.Call(stubs.AliveCellGetter, turnRequest, turnResponse)
+func callPauseAndResume(client *rpc.Client, req stubs.PauseRequest) int {
+	res := new(stubs.PauseResponse)
+	err := client.Call(stubs.PauseAndResume, req, res)
 	if err != nil {
 		fmt.Println(err)
 	}
-	return turnResponse.Turn, turnResponse.NumOfAliveCells
+	return res.Turn
+}
+
+func callAttach(client *rpc.Client, req stubs.AttachRequest) (stubs.AttachResponse, error) {
+	attachResponse := new(stubs.AttachResponse)
+	err := client.Call(stubs.Attach, req, attachResponse)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return *attachResponse, err
 }
 
-func callPauseAndResume(client *rpc.Client, req stubs.PauseRequest) {
-	err := client.Call(stubs.PauseAndResume, req, &stubs.EmptyResponse{})
+func callCheckpoint(client *rpc.Client, p Params) (stubs.CheckpointResponse, error) {
+	checkpointResponse := new(stubs.CheckpointResponse)
+	err := client.Call(stubs.GetCheckpoint, stubs.CheckpointRequest{ImageWidth: p.ImageWidth, ImageHeight: p.ImageHeight}, checkpointResponse)
 	if err != nil {
 		fmt.Println(err)
 	}
+	return *checkpointResponse, err
 }
 
-func callWorld(client *rpc.Client) [][]uint8 {
+func callWorld(client *rpc.Client, game int) util.BitBoard {
 	worldResponse := new(stubs.WorldResponse)
-	err := client.Call(stubs.GetWorld, stubs.EmptyRequest{}, worldResponse)
+	err := client.Call(stubs.GetWorld, stubs.GameRequest{Game: game}, worldResponse)
 	if err != nil {
 		fmt.Println(err)
 	}
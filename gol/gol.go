@@ -1,44 +1,75 @@
 package gol
 
+import "uk.ac.bris.cs/gameoflife/util"
+
+// Server is the IP:port of the broker the distributor sends the game to.
 var Server string
 
+// CellEdits takes cells clicked on in the window. While the game is paused the distributor flips them in it.
+var CellEdits = make(chan util.Cell, 256)
+
 // Params provides the details of how to run the Game of Life and which image to load.
 type Params struct {
 	Turns       int
 	Threads     int
 	ImageWidth  int
 	ImageHeight int
+	Rule        string // Life-like rule in B/S notation, e.g. "B36/S23"; empty means Conway's B3/S23
+	Boundary    string // what lies past the edges: util.Torus, util.Dead or util.Klein; empty means a torus
+	Resume      bool   // carry on from the broker's newest checkpoint instead of loading the image
+
+	InputPath    string // file to load instead of images/<w>x<h>, the board has to be the size InputSize gives for it
+	InputFormat  string // "pgm" or "rle", empty goes by the extension or whichever file is in images/
+	Threshold    int    // grey level from 0 to 255 at and above which a pgm pixel is alive, 0 means DefaultThreshold
+	OutputDir    string // where images are written, empty means out/
+	OutputFormat string // "pgm", "rle" or "png", empty means pgm
+
+	Scale           int    // pixels per cell side in png and animation output, 0 means 1
+	FrameEvery      int    // turns between animation frames, 0 means no animation
+	AnimationFormat string // "gif" for an animated GIF or "png" for numbered frames, empty means gif
+	FrameRate       int    // frames a second the game is shown at, 0 shows every turn and holds the game to the window's pace
+	Observe         bool   // watch the game running on the broker without controlling it
+	Game            int    // the game on the broker to control or observe, 0 lets the broker pick
 }
 
 // Run starts the processing of Game of Life. It should initialise channels and goroutines.
 func Run(p Params, events chan<- Event, keyPresses <-chan rune) {
 
 	if Server == "" { // to make test cases work
-		Server = "localhost"
+		Server = "localhost:8003"
+	}
+	if p.Rule == "" {
+		p.Rule = util.DefaultRule
+	}
+	if p.Boundary == "" {
+		p.Boundary = util.Torus
 	}
 
 	fname := make(chan string)
 	out := make(chan uint8)
 	in := make(chan uint8)
+	inError := make(chan error)
 	ioCommand := make(chan ioCommand)
 	ioIdle := make(chan bool)
 
 	ioChannels := ioChannels{
-		command:  ioCommand,
-		idle:     ioIdle,
-		filename: fname,
-		output:   out,
-		input:    in,
+		command:    ioCommand,
+		idle:       ioIdle,
+		filename:   fname,
+		output:     out,
+		input:      in,
+		inputError: inError,
 	}
 	go startIo(p, ioChannels)
 
 	distributorChannels := distributorChannels{
-		events:     events,
-		ioCommand:  ioCommand,
-		ioIdle:     ioIdle,
-		ioFilename: fname,
-		ioOutput:   out,
-		ioInput:    in,
+		events:       events,
+		ioCommand:    ioCommand,
+		ioIdle:       ioIdle,
+		ioFilename:   fname,
+		ioOutput:     out,
+		ioInput:      in,
+		ioInputError: inError,
 
 	}
 
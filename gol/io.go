@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -14,15 +15,18 @@ type ioChannels struct {
 	command <-chan ioCommand
 	idle    chan<- bool
 
-	filename <-chan string
-	output   <-chan uint8
-	input    chan<- uint8
+	filename   <-chan string
+	output     <-chan uint8
+	input      chan<- uint8
+	inputError chan<- error
 }
 
 // ioState is the internal ioState of the io goroutine.
 type ioState struct {
-	params   Params
-	channels ioChannels
+	params     Params
+	channels   ioChannels
+	animation  *animation
+	frameCount int
 }
 
 // ioCommand allows requesting behaviour from the io (pgm) goroutine.
@@ -33,20 +37,42 @@ type ioCommand uint8
 //		ioOutput 	= 0
 //		ioInput 	= 1
 //		ioCheckIdle = 2
+//		ioFrame 	= 3
 const (
 	ioOutput ioCommand = iota
 	ioInput
 	ioCheckIdle
+	ioFrame
 )
 
-// writePgmImage receives an array of bytes and writes it to a pgm file.
-func (io *ioState) writePgmImage() {
-	_ = os.Mkdir("out", os.ModePerm)
-
+// writeImage writes the world in the format given by -output, pgm unless it says rle or png.
+func (io *ioState) writeImage() {
 	// Request a filename from the distributor.
 	filename := <-io.channels.filename
 
-	file, ioError := os.Create("out/" + filename + ".pgm")
+	// the distributor has checked the format with CheckOutputFormat
+	switch io.params.OutputFormat {
+	case "rle":
+		io.writeRleImage(filename)
+	case "png":
+		io.writePngImage(filename)
+	default:
+		io.writePgmImage(filename)
+	}
+}
+
+// CheckOutputFormat returns an error unless the format is one writeImage can write, "" meaning pgm.
+func CheckOutputFormat(format string) error {
+	switch format {
+	case "", "pgm", "rle", "png":
+		return nil
+	}
+	return fmt.Errorf("output format %q is not one of pgm, rle or png", format)
+}
+
+// writePgmImage receives an array of bytes and writes it to a pgm file.
+func (io *ioState) writePgmImage(filename string) {
+	file, ioError := os.Create(outputPath(io.params, filename, ".pgm"))
 	util.Check(ioError)
 	defer file.Close()
 
@@ -87,43 +113,114 @@ func (io *ioState) writePgmImage() {
 	fmt.Println("File", filename, "output done!")
 }
 
-// readPgmImage opens a pgm file and sends its data as an array of bytes.
-func (io *ioState) readPgmImage() {
-
-	// Request a filename from the distributor.
-	filename := <-io.channels.filename
-
-	data, ioError := ioutil.ReadFile("images/" + filename + ".pgm")
-	util.Check(ioError)
-
-	fields := strings.Fields(string(data))
-
-	if fields[0] != "P5" {
-		panic("Not a pgm file")
+// inputFile returns the file to load and its format. That is p.InputPath if it is set, in the format given by
+// -input or else its extension, and otherwise images/<name>.pgm or .rle, whichever is there.
+func inputFile(p Params, name string) (string, string) {
+	format := p.InputFormat
+	if p.InputPath != "" {
+		if format == "" {
+			format = "pgm"
+			if strings.EqualFold(filepath.Ext(p.InputPath), ".rle") {
+				format = "rle"
+			}
+		}
+		return p.InputPath, format
 	}
+	if format == "" {
+		format = "pgm"
+		if _, err := os.Stat("images/" + name + ".pgm"); os.IsNotExist(err) {
+			if _, err := os.Stat("images/" + name + ".rle"); err == nil {
+				format = "rle"
+			}
+		}
+	}
+	return "images/" + name + "." + format, format
+}
 
-	width, _ := strconv.Atoi(fields[1])
-	if width != io.params.ImageWidth {
-		panic("Incorrect width")
+// InputSize returns the size of board p.InputPath needs: a PGM or PBM's own size, or the board in p grown to fit an RLE pattern.
+func InputSize(p Params) (int, int, error) {
+	path, format := inputFile(p, "")
+	switch format {
+	case "pgm", "pbm":
+		return pnmSize(path)
+	case "rle":
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return 0, 0, err
+		}
+		width, height, _, _, err := parseRle(string(data))
+		if err != nil {
+			return 0, 0, err
+		}
+		if p.ImageWidth > width {
+			width = p.ImageWidth
+		}
+		if p.ImageHeight > height {
+			height = p.ImageHeight
+		}
+		return width, height, nil
 	}
+	return 0, 0, fmt.Errorf("unknown input format %s", format)
+}
 
-	height, _ := strconv.Atoi(fields[2])
-	if height != io.params.ImageHeight {
-		panic("Incorrect height")
+// InputRule returns the rule in the header of the RLE pattern at p.InputPath, or "" if it does not give one.
+func InputRule(p Params) (string, error) {
+	path, format := inputFile(p, "")
+	if format != "rle" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
 	}
+	_, _, rule, _, err := parseRle(string(data))
+	if err != nil || rule == "" {
+		return "", err
+	}
+	if _, err := util.ParseRule(rule); err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	return rule, nil
+}
 
-	maxval, _ := strconv.Atoi(fields[3])
-	if maxval != 255 {
-		panic("Incorrect maxval/bit depth")
+// outputPath returns where an output file goes, in p.OutputDir or out/ by default, making the directory if needed.
+func outputPath(p Params, filename, extension string) string {
+	dir := p.OutputDir
+	if dir == "" {
+		dir = "out"
 	}
+	path := filepath.Join(dir, filename+extension)
+	_ = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	return path
+}
 
-	image := []byte(fields[4])
+// readImage loads the image from the file inputFile picks. The distributor is sent whether that worked
+// before the image, so a bad file ends the game rather than the program.
+func (io *ioState) readImage() {
+	// Request a filename from the distributor.
+	filename := <-io.channels.filename
+
+	path, format := inputFile(io.params, filename)
+	var image []byte
+	var err error
+	switch format {
+	case "pgm", "pbm":
+		image, err = readPgmImage(io.params, path)
+	case "rle":
+		image, err = readRleImage(io.params, path)
+	default:
+		err = fmt.Errorf("unknown input format %s", format)
+	}
 
+	io.channels.inputError <- err
+	if err != nil {
+		return
+	}
 	for _, b := range image {
 		io.channels.input <- b
 	}
 
-	fmt.Println("File", filename, "input done!")
+	fmt.Println("File", path, "input done!")
 }
 
 // startIo should be the entrypoint of the io goroutine.
@@ -139,10 +236,14 @@ func startIo(p Params, c ioChannels) {
 		case command := <-io.channels.command:
 			switch command {
 			case ioInput:
-				io.readPgmImage()
+				io.readImage()
 			case ioOutput:
-				io.writePgmImage()
+				io.writeImage()
+			case ioFrame:
+				io.writeFrame()
 			case ioCheckIdle:
+				// The distributor only checks when it is done, so a GIF being built has all its frames
+				io.flushAnimation()
 				io.channels.idle <- true
 			}
 		}
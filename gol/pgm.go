@@ -0,0 +1,231 @@
+package gol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DefaultThreshold is the grey level, on a 0 to 255 scale, at and above which a pixel is an alive cell.
+const DefaultThreshold = 128
+
+// pnmHeader is the start of a PBM or PGM file. Bitmaps have no maxval in the file, it is taken as 1.
+type pnmHeader struct {
+	magic  string
+	width  int
+	height int
+	maxval int
+}
+
+// readPnmToken skips whitespace and # comments and returns the next run of other bytes.
+func readPnmToken(r *bufio.Reader) (string, error) {
+	var token []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(token) > 0 {
+				return string(token), nil
+			}
+			return "", err
+		}
+		switch {
+		case b == '#' && len(token) == 0:
+			if _, err := r.ReadString('\n'); err != nil {
+				return "", err
+			}
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f':
+			if len(token) > 0 {
+				return string(token), nil
+			}
+		default:
+			token = append(token, b)
+		}
+	}
+}
+
+// readPnmInt reads the next token as a number no smaller than min.
+func readPnmInt(r *bufio.Reader, name string, min int) (int, error) {
+	token, err := readPnmToken(r)
+	if err != nil {
+		return 0, fmt.Errorf("reading the %s: %v", name, err)
+	}
+	n := 0
+	for _, digit := range token {
+		if digit < '0' || digit > '9' || n > 1<<24 {
+			return 0, fmt.Errorf("the %s %q is not a number", name, token)
+		}
+		n = n*10 + int(digit-'0')
+	}
+	if n < min {
+		return 0, fmt.Errorf("the %s is %d, it has to be at least %d", name, n, min)
+	}
+	return n, nil
+}
+
+// readPnmHeader reads the magic number, size and maxval. For binary files it also eats the single
+// whitespace byte before the raster, so the reader is left on the first pixel.
+func readPnmHeader(r *bufio.Reader) (pnmHeader, error) {
+	var h pnmHeader
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(r, magic); err != nil || magic[0] != 'P' {
+		return h, fmt.Errorf("not a pbm or pgm file")
+	}
+	h.magic = string(magic)
+	switch h.magic {
+	case "P1", "P2", "P4", "P5":
+	default:
+		return h, fmt.Errorf("%s files are not supported, only P1, P2, P4 and P5", h.magic)
+	}
+
+	var err error
+	if h.width, err = readPnmInt(r, "width", 1); err != nil {
+		return h, err
+	}
+	if h.height, err = readPnmInt(r, "height", 1); err != nil {
+		return h, err
+	}
+	h.maxval = 1
+	if h.magic == "P2" || h.magic == "P5" {
+		if h.maxval, err = readPnmInt(r, "maxval", 1); err != nil {
+			return h, err
+		}
+		if h.maxval > 65535 {
+			return h, fmt.Errorf("the maxval is %d, it can be at most 65535", h.maxval)
+		}
+	}
+	// readPnmToken has already eaten the whitespace byte after the last number
+	return h, nil
+}
+
+// decodePnm reads a P1, P2, P4 or P5 file and returns a byte per cell, 255 for alive and 0 for dead.
+// In bitmaps a 1 (black) is alive, in graymaps a pixel is alive if its grey level, scaled to 0 to 255,
+// is at least threshold.
+func decodePnm(reader io.Reader, threshold int) (pnmHeader, []byte, error) {
+	r := bufio.NewReader(reader)
+	h, err := readPnmHeader(r)
+	if err != nil {
+		return h, nil, err
+	}
+	if threshold <= 0 {
+		threshold = DefaultThreshold
+	}
+
+	image := make([]byte, h.width*h.height)
+	alive := func(i, value int) error {
+		if value > h.maxval {
+			return fmt.Errorf("pixel %d is %d, more than the maxval of %d", i, value, h.maxval)
+		}
+		if h.maxval == 1 && value == 1 || h.maxval > 1 && value*255/h.maxval >= threshold {
+			image[i] = 255
+		}
+		return nil
+	}
+
+	switch h.magic {
+	case "P1":
+		// Bits can be run together, so each one is read as a byte of its own
+		for i := range image {
+			b, err := readPnmBit(r)
+			if err != nil {
+				return h, nil, fmt.Errorf("reading pixel %d: %v", i, err)
+			}
+			_ = alive(i, b)
+		}
+	case "P2":
+		for i := range image {
+			value, err := readPnmInt(r, fmt.Sprintf("pixel %d", i), 0)
+			if err != nil {
+				return h, nil, err
+			}
+			if err := alive(i, value); err != nil {
+				return h, nil, err
+			}
+		}
+	case "P4":
+		row := make([]byte, (h.width+7)/8)
+		for y := 0; y < h.height; y++ {
+			if _, err := io.ReadFull(r, row); err != nil {
+				return h, nil, fmt.Errorf("reading row %d: %v", y, err)
+			}
+			for x := 0; x < h.width; x++ {
+				_ = alive(y*h.width+x, int(row[x/8]>>uint(7-x%8)&1))
+			}
+		}
+	case "P5":
+		sampleBytes := 1
+		if h.maxval > 255 {
+			sampleBytes = 2
+		}
+		row := make([]byte, h.width*sampleBytes)
+		for y := 0; y < h.height; y++ {
+			if _, err := io.ReadFull(r, row); err != nil {
+				return h, nil, fmt.Errorf("reading row %d: %v", y, err)
+			}
+			for x := 0; x < h.width; x++ {
+				value := int(row[x])
+				if sampleBytes == 2 {
+					value = int(row[2*x])<<8 | int(row[2*x+1])
+				}
+				if err := alive(y*h.width+x, value); err != nil {
+					return h, nil, err
+				}
+			}
+		}
+	}
+	return h, image, nil
+}
+
+// readPnmBit reads the next 0 or 1 of a P1 raster, skipping whitespace and comments.
+func readPnmBit(r *bufio.Reader) (int, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case '0', '1':
+			return int(b - '0'), nil
+		case '#':
+			if _, err := r.ReadString('\n'); err != nil {
+				return 0, err
+			}
+		case ' ', '\t', '\n', '\r', '\v', '\f':
+		default:
+			return 0, fmt.Errorf("unexpected %q in a P1 raster", b)
+		}
+	}
+}
+
+// pnmSize returns the size of the bitmap or graymap at path without reading its pixels.
+func pnmSize(path string) (int, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	h, err := readPnmHeader(bufio.NewReader(file))
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %v", path, err)
+	}
+	return h.width, h.height, nil
+}
+
+// readPgmImage opens a pbm or pgm file and checks it is the size of the board, returning its cells
+// as an array of bytes.
+func readPgmImage(p Params, path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h, image, err := decodePnm(file, p.Threshold)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if h.width != p.ImageWidth || h.height != p.ImageHeight {
+		return nil, fmt.Errorf("%s is %dx%d, not %dx%d", path, h.width, h.height, p.ImageWidth, p.ImageHeight)
+	}
+	return image, nil
+}
@@ -0,0 +1,67 @@
+package gol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodePnm(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		threshold int
+		// one character a cell, # for alive and . for dead
+		want string
+	}{
+		{"P1", "P1\n3 2\n1 0 1\n0 1 0\n", 0, "#.#.#."},
+		{"P1 run together", "P1 3 2 101010", 0, "#.#.#."},
+		{"P1 comments", "P1\n# a comment\n3 # another\n2\n1 0 # in the raster\n1\n0 1 0\n", 0, "#.#.#."},
+		{"P2", "P2\n2 2\n15\n0 8\n7 15\n", 0, ".#.#"},
+		{"P2 threshold", "P2\n2 2\n15\n0 8\n7 15\n", 100, ".###"},
+		{"P4", "P4\n10 2\n\xA0\x40\x80\xC0", 0, "#.#......#" + "#.......##"},
+		{"P5", "P5\n3 1\n255\n\x00\x80\xFF", 0, ".##"},
+		{"P5 threshold", "P5\n3 1\n255\n\x00\x80\xFF", 200, "..#"},
+		{"P5 16-bit", "P5\n3 1\n65535\n\x00\xFF\x80\x80\xFF\xFF", 0, ".##"},
+		{"P5 comment", "P5\n#made by hand\n2 1 255\n\xFF\x00", 0, "#."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, image, err := decodePnm(strings.NewReader(test.file), test.threshold)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got strings.Builder
+			for _, value := range image {
+				if value == 255 {
+					got.WriteByte('#')
+				} else {
+					got.WriteByte('.')
+				}
+			}
+			if got.String() != test.want {
+				t.Errorf("got %s, want %s", got.String(), test.want)
+			}
+		})
+	}
+
+	for _, test := range []struct{ name, file string }{
+		{"empty", ""},
+		{"P3", "P3\n1 1\n255\n0 0 0\n"},
+		{"no height", "P2\n2"},
+		{"zero width", "P2\n0 2\n255\n"},
+		{"maxval too big", "P5\n1 1\n65536\n\x00\x00"},
+		{"truncated P1", "P1\n3 2\n1 0 1\n0"},
+		{"truncated P2", "P2\n2 2\n255\n0 1 2"},
+		{"truncated P4", "P4\n10 2\n\xA0\x40\x80"},
+		{"truncated P5", "P5\n3 2\n255\n\x00\x80\xFF\x00"},
+		{"truncated 16-bit P5", "P5\n2 1\n65535\n\x00\xFF\x80"},
+		{"more than maxval", "P2\n2 1\n15\n0 16\n"},
+		{"bad P1 raster", "P1\n2 1\n1 2\n"},
+	} {
+		t.Run("invalid "+test.name, func(t *testing.T) {
+			if _, _, err := decodePnm(strings.NewReader(test.file), 0); err == nil {
+				t.Errorf("decoding %q did not fail", test.file)
+			}
+		})
+	}
+}
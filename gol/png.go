@@ -0,0 +1,124 @@
+package gol
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"os"
+
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// gifFrameDelay is how long each frame of an animated GIF is shown, in hundredths of a second.
+const gifFrameDelay = 10
+
+// cellPalette draws dead cells black and alive cells white, as in the PGM images.
+var cellPalette = color.Palette{color.Black, color.White}
+
+// animation is an animated GIF being built up one frame at a time, it is written out when the io goroutine is next
+// asked whether it is idle.
+type animation struct {
+	name   string
+	frames *gif.GIF
+}
+
+// receiveWorld reads a world from the distributor a byte per cell, a row at a time.
+func (io *ioState) receiveWorld() [][]byte {
+	world := make([][]byte, io.params.ImageHeight)
+	for y := range world {
+		world[y] = make([]byte, io.params.ImageWidth)
+		for x := range world[y] {
+			world[y][x] = <-io.channels.output
+		}
+	}
+	return world
+}
+
+// cellImage draws a world with each cell as a square of scale by scale pixels.
+func cellImage(world [][]byte, width, height, scale int) *image.Paletted {
+	if scale < 1 {
+		scale = 1
+	}
+	img := image.NewPaletted(image.Rect(0, 0, width*scale, height*scale), cellPalette)
+	for y := 0; y < height*scale; y++ {
+		row := world[y/scale]
+		pixels := img.Pix[y*img.Stride : y*img.Stride+width*scale]
+		for x := range pixels {
+			if row[x/scale] != 0 {
+				pixels[x] = 1
+			}
+		}
+	}
+	return img
+}
+
+func writePng(path string, img image.Image) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writePngImage receives an array of bytes and writes it to a png file.
+func (io *ioState) writePngImage(filename string) {
+	world := io.receiveWorld()
+	img := cellImage(world, io.params.ImageWidth, io.params.ImageHeight, io.params.Scale)
+	util.Check(writePng(outputPath(io.params, filename, ".png"), img))
+
+	fmt.Println("File", filename, "output done!")
+}
+
+// writeFrame receives one frame of an animation. GIF frames are kept until flushAnimation, PNG frames
+// are written straight away as a numbered sequence in a directory of their own.
+func (io *ioState) writeFrame() {
+	// Request the animation's name from the distributor.
+	name := <-io.channels.filename
+
+	world := io.receiveWorld()
+	img := cellImage(world, io.params.ImageWidth, io.params.ImageHeight, io.params.Scale)
+
+	// the distributor has checked the format with CheckAnimationFormat
+	switch io.params.AnimationFormat {
+	case "png":
+		frame := fmt.Sprintf("%06d", io.frameCount)
+		util.Check(writePng(outputPath(io.params, name+"_frames/"+frame, ".png"), img))
+	default:
+		if io.animation == nil || io.animation.name != name {
+			io.flushAnimation()
+			io.animation = &animation{name: name, frames: &gif.GIF{}}
+		}
+		io.animation.frames.Image = append(io.animation.frames.Image, img)
+		io.animation.frames.Delay = append(io.animation.frames.Delay, gifFrameDelay)
+	}
+	io.frameCount++
+}
+
+// flushAnimation writes out the animated GIF built up so far, if there is one.
+func (io *ioState) flushAnimation() {
+	if io.animation == nil {
+		return
+	}
+	file, ioError := os.Create(outputPath(io.params, io.animation.name, ".gif"))
+	util.Check(ioError)
+	defer file.Close()
+	util.Check(gif.EncodeAll(file, io.animation.frames))
+
+	fmt.Println("File", io.animation.name, "animation done!")
+	io.animation = nil
+}
+
+// CheckAnimationFormat returns an error unless the format is one writeFrame can write, "" meaning gif.
+func CheckAnimationFormat(format string) error {
+	switch format {
+	case "", "gif", "png":
+		return nil
+	}
+	return fmt.Errorf("animation format %q is not one of gif or png", format)
+}
@@ -0,0 +1,203 @@
+package gol
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// rleLineLength is the longest line written in an RLE body, as other Life programs expect.
+const rleLineLength = 70
+
+// parseRle reads an RLE pattern, returning its size, the rule in its header ("" if it has none) and alive cells.
+// Lines starting with # are comments, the first other line is the "x = m, y = n, rule = abc" header. Cells are b or .
+// when dead and o or A when alive, patterns of multi-state rules, with cells in other states, are rejected.
+func parseRle(text string) (int, int, string, []util.Cell, error) {
+	var width, height int
+	var rule string
+	var body strings.Builder
+	header := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if header {
+			body.WriteString(line)
+			continue
+		}
+		header = true
+		var err error
+		width, height, rule, err = parseRleHeader(line)
+		if err != nil {
+			return 0, 0, "", nil, err
+		}
+	}
+	if !header {
+		return 0, 0, "", nil, fmt.Errorf("no RLE header")
+	}
+
+	var alive []util.Cell
+	x, y, count := 0, 0, 0
+	for _, r := range body.String() {
+		if r >= '0' && r <= '9' {
+			count = count*10 + int(r-'0')
+			continue
+		}
+		run := count
+		if run == 0 {
+			run = 1
+		}
+		count = 0
+		switch {
+		case r == '!':
+			return width, height, rule, alive, nil
+		case r == '$':
+			x = 0
+			y += run
+		case r == 'b' || r == '.':
+			x += run
+		case r == 'o' || r == 'A':
+			for i := 0; i < run; i++ {
+				if x >= width || y >= height {
+					return 0, 0, "", nil, fmt.Errorf("RLE pattern goes past its %dx%d header", width, height)
+				}
+				alive = append(alive, util.Cell{X: x, Y: y})
+				x++
+			}
+		case r == ' ' || r == '\t' || r == '\r':
+		case r >= 'a' && r <= 'z' || r >= 'B' && r <= 'Z':
+			return 0, 0, "", nil, fmt.Errorf("RLE pattern has a cell in state %q, only two-state patterns can be run", r)
+		default:
+			return 0, 0, "", nil, fmt.Errorf("unexpected %q in RLE pattern", r)
+		}
+	}
+	return width, height, rule, alive, nil
+}
+
+// parseRleHeader reads the "x = m, y = n, rule = abc" line of an RLE pattern. The rule runs to the end of the line,
+// as a bounded grid after it has commas of its own, e.g. "B3/S23:T10,10". The bounded grid is dropped, the board's
+// size and edges come from the flags.
+func parseRleHeader(line string) (int, int, string, error) {
+	var width, height int
+	var rule string
+	rest := line
+	for rest != "" {
+		keyValue := strings.SplitN(rest, "=", 2)
+		if len(keyValue) != 2 {
+			return 0, 0, "", fmt.Errorf("bad RLE header %q", line)
+		}
+		key, value := strings.TrimSpace(keyValue[0]), keyValue[1]
+		rest = ""
+		if i := strings.Index(value, ","); i >= 0 && key != "rule" {
+			value, rest = value[:i], value[i+1:]
+		}
+		value = strings.TrimSpace(value)
+		var err error
+		switch key {
+		case "x":
+			width, err = strconv.Atoi(value)
+		case "y":
+			height, err = strconv.Atoi(value)
+		case "rule":
+			rule = strings.TrimSpace(strings.SplitN(value, ":", 2)[0])
+		}
+		if err != nil {
+			return 0, 0, "", fmt.Errorf("bad RLE header %q", line)
+		}
+	}
+	return width, height, rule, nil
+}
+
+// encodeRle writes a world as an RLE pattern with the rule in its header.
+func encodeRle(width, height int, rule string, world [][]byte) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "x = %d, y = %d, rule = %s\n", width, height, rule)
+
+	lineLength := 0
+	write := func(run int, tag byte) {
+		token := string(tag)
+		if run > 1 {
+			token = strconv.Itoa(run) + token
+		}
+		if lineLength+len(token) > rleLineLength {
+			out.WriteString("\n")
+			lineLength = 0
+		}
+		out.WriteString(token)
+		lineLength += len(token)
+	}
+
+	newLines := 0
+	for y := 0; y < height; y++ {
+		x := 0
+		for x < width {
+			alive := world[y][x] != 0
+			run := 1
+			for x+run < width && (world[y][x+run] != 0) == alive {
+				run++
+			}
+			// dead cells at the end of a row are left out
+			if !alive && x+run == width {
+				break
+			}
+			if newLines > 0 {
+				write(newLines, '$')
+				newLines = 0
+			}
+			if alive {
+				write(run, 'o')
+			} else {
+				write(run, 'b')
+			}
+			x += run
+		}
+		newLines++
+	}
+	write(1, '!')
+	out.WriteString("\n")
+	return out.String()
+}
+
+// readRleImage opens an RLE pattern and returns it, centred in the board, as an array of bytes.
+func readRleImage(p Params, path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	width, height, _, alive, err := parseRle(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if width > p.ImageWidth || height > p.ImageHeight {
+		return nil, fmt.Errorf("%s is %dx%d, bigger than the %dx%d board", path, width, height, p.ImageWidth, p.ImageHeight)
+	}
+
+	offsetX := (p.ImageWidth - width) / 2
+	offsetY := (p.ImageHeight - height) / 2
+	image := make([]byte, p.ImageWidth*p.ImageHeight)
+	for _, cell := range alive {
+		image[(cell.Y+offsetY)*p.ImageWidth+cell.X+offsetX] = 255
+	}
+	return image, nil
+}
+
+// writeRleImage receives an array of bytes and writes it to an RLE file.
+func (io *ioState) writeRleImage(filename string) {
+	world := make([][]byte, io.params.ImageHeight)
+	for y := range world {
+		world[y] = make([]byte, io.params.ImageWidth)
+		for x := range world[y] {
+			world[y][x] = <-io.channels.output
+		}
+	}
+
+	ioError := ioutil.WriteFile(outputPath(io.params, filename, ".rle"), []byte(encodeRle(io.params.ImageWidth, io.params.ImageHeight, io.params.Rule, world)), 0644)
+	util.Check(ioError)
+
+	fmt.Println("File", filename, "output done!")
+}
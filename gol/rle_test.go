@@ -0,0 +1,141 @@
+package gol
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+func TestParseRle(t *testing.T) {
+	glider := "#N Glider\n#C a comment\nx = 3, y = 3, rule = B3/S23\nbob$2bo$3o!\n"
+	width, height, rule, alive, err := parseRle(glider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width != 3 || height != 3 || rule != "B3/S23" {
+		t.Errorf("header read as %dx%d %q, want 3x3 \"B3/S23\"", width, height, rule)
+	}
+	want := []util.Cell{{X: 1, Y: 0}, {X: 2, Y: 1}, {X: 0, Y: 2}, {X: 1, Y: 2}, {X: 2, Y: 2}}
+	if fmt.Sprint(alive) != fmt.Sprint(want) {
+		t.Errorf("alive cells are %v, want %v", alive, want)
+	}
+
+	// the body can run over several lines and skip rows, and the rule is optional
+	_, _, rule, alive, err = parseRle("x = 4, y = 5\n2o\n2$3bo!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []util.Cell{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 3, Y: 2}}
+	if rule != "" || fmt.Sprint(alive) != fmt.Sprint(want) {
+		t.Errorf("read rule %q and cells %v, want \"\" and %v", rule, alive, want)
+	}
+
+	// the rule runs to the end of the line, a bounded grid after it is dropped
+	for _, test := range []struct{ header, rule string }{
+		{"x = 3, y = 2, rule = B3/S23:T10,10", "B3/S23"},
+		{"x=3,y=2,rule=B36/S23:P3,2", "B36/S23"},
+		{"x = 3, y = 2, rule = B3/S23 ", "B3/S23"},
+	} {
+		width, height, rule, _, err := parseRle(test.header + "\no!")
+		if err != nil {
+			t.Errorf("parseRle(%q): %v", test.header, err)
+		} else if width != 3 || height != 2 || rule != test.rule {
+			t.Errorf("%q read as %dx%d %q, want 3x2 %q", test.header, width, height, rule, test.rule)
+		}
+	}
+
+	// multi-state patterns write alive cells as A, two-state ones as o
+	_, _, _, alive, err = parseRle("x = 3, y = 1\nA.A!")
+	want = []util.Cell{{X: 0, Y: 0}, {X: 2, Y: 0}}
+	if err != nil || fmt.Sprint(alive) != fmt.Sprint(want) {
+		t.Errorf("read cells %v (%v), want %v", alive, err, want)
+	}
+
+	for _, text := range []string{
+		"",
+		"#C only comments",
+		"x = 3 y = 3\no!",
+		"x = three, y = 3\no!",
+		"x = 2, y = 2\n3o!",
+		"x = 2, y = 2\n$$o!",
+		"x = 2, y = 2\no*!",
+		"x = 2, y = 2\nAB!",
+		"x = 2, y = 2\npA!",
+	} {
+		if _, _, _, _, err := parseRle(text); err == nil {
+			t.Errorf("parseRle(%q) did not fail", text)
+		}
+	}
+}
+
+func TestEncodeRle(t *testing.T) {
+	for _, size := range []struct{ width, height int }{{16, 16}, {100, 7}, {129, 40}} {
+		t.Run(fmt.Sprintf("%dx%d", size.width, size.height), func(t *testing.T) {
+			world := make([][]byte, size.height)
+			var want []util.Cell
+			for y := range world {
+				world[y] = make([]byte, size.width)
+				for x := range world[y] {
+					if (x*7+y*3)%5 < 2 {
+						world[y][x] = 255
+						want = append(want, util.Cell{X: x, Y: y})
+					}
+				}
+			}
+			text := encodeRle(size.width, size.height, "B36/S23", world)
+			for _, line := range strings.Split(text, "\n")[1:] {
+				if len(line) > rleLineLength {
+					t.Fatalf("line %q is longer than %d", line, rleLineLength)
+				}
+			}
+			width, height, rule, alive, err := parseRle(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if width != size.width || height != size.height || rule != "B36/S23" {
+				t.Errorf("header read back as %dx%d %q", width, height, rule)
+			}
+			if fmt.Sprint(alive) != fmt.Sprint(want) {
+				t.Errorf("the cells did not survive the round trip")
+			}
+		})
+	}
+}
+
+func TestReadRleImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "glider.rle")
+	err = ioutil.WriteFile(path, []byte("x = 3, y = 3\nbob$2bo$3o!\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := readRleImage(Params{ImageWidth: 8, ImageHeight: 6}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the 3x3 glider starts at 2,1 on an 8x6 board
+	want := []util.Cell{{X: 3, Y: 1}, {X: 4, Y: 2}, {X: 2, Y: 3}, {X: 3, Y: 3}, {X: 4, Y: 3}}
+	var alive []util.Cell
+	for i, value := range image {
+		if value == 255 {
+			alive = append(alive, util.Cell{X: i % 8, Y: i / 8})
+		}
+	}
+	if fmt.Sprint(alive) != fmt.Sprint(want) {
+		t.Errorf("alive cells are %v, want %v", alive, want)
+	}
+
+	if _, err := readRleImage(Params{ImageWidth: 2, ImageHeight: 6}, path); err == nil {
+		t.Errorf("a 3x3 pattern fitted on a 2x6 board")
+	}
+}
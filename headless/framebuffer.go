@@ -0,0 +1,66 @@
+package headless
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Framebuffer is the world as the events have drawn it, a byte per cell that is 0xFF when the cell is alive.
+// It is what sdl.Window keeps in its pixels, without a window to show them in.
+type Framebuffer struct {
+	Width, Height int
+	pixels        []byte
+}
+
+func NewFramebuffer(width, height int) *Framebuffer {
+	return &Framebuffer{width, height, make([]byte, width*height)}
+}
+
+func (f *Framebuffer) FlipPixel(x, y int) {
+	if x < 0 || y < 0 || x >= f.Width || y >= f.Height {
+		panic(fmt.Sprintf("CellFlipped event at (%d, %d) is outside the bounds of the framebuffer.", x, y))
+	}
+	f.pixels[y*f.Width+x] = ^f.pixels[y*f.Width+x]
+}
+
+// Alive reports whether the cell at (x, y) is alive, cells off the edge are dead.
+func (f *Framebuffer) Alive(x, y int) bool {
+	if x < 0 || y < 0 || x >= f.Width || y >= f.Height {
+		return false
+	}
+	return f.pixels[y*f.Width+x] == 0xFF
+}
+
+func (f *Framebuffer) CountPixels() int {
+	count := 0
+	for _, pixel := range f.pixels {
+		if pixel == 0xFF {
+			count++
+		}
+	}
+	return count
+}
+
+// Dump writes the framebuffer to dir as a PGM named after its size and turn, the same way the
+// distributor names its images.
+func (f *Framebuffer) Dump(dir string, turn int) (string, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, strconv.Itoa(f.Width)+"x"+strconv.Itoa(f.Height)+"x"+strconv.Itoa(turn)+".pgm")
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	_, err = fmt.Fprintf(file, "P5\n%d %d\n255\n", f.Width, f.Height)
+	if err == nil {
+		_, err = file.Write(f.pixels)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return path, err
+}
@@ -0,0 +1,65 @@
+package headless
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// Keyboard reads key presses from the terminal one at a time, without waiting for enter or echoing them.
+// The terminal is switched over with stty, which every system with a terminal to switch has.
+type Keyboard struct {
+	saved string
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// OpenKeyboard puts the terminal into cbreak mode, returning an error if stdin is not a terminal.
+// Ctrl-C still interrupts, and puts the terminal back before exiting.
+func OpenKeyboard() (*Keyboard, error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	_, err = stty("-icanon", "-echo", "min", "1", "time", "0")
+	if err != nil {
+		return nil, err
+	}
+	k := &Keyboard{saved}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupts
+		k.Close()
+		os.Exit(1)
+	}()
+	return k, nil
+}
+
+// Read sends the keys the SDL window listens for into keyPresses, until stdin closes.
+func (k *Keyboard) Read(keyPresses chan<- rune) {
+	key := make([]byte, 1)
+	for {
+		_, err := os.Stdin.Read(key)
+		if err != nil {
+			return
+		}
+		switch key[0] {
+		case 'p', 's', 'q', 'k', 'n', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			keyPresses <- rune(key[0])
+		}
+	}
+}
+
+// Close puts the terminal back the way OpenKeyboard found it.
+func (k *Keyboard) Close() {
+	_, _ = stty(k.saved)
+}
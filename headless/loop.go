@@ -0,0 +1,132 @@
+package headless
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"uk.ac.bris.cs/gameoflife/gol"
+)
+
+// renderInterval is the least time between terminal frames, drawing every turn would flood the terminal.
+const renderInterval = 50 * time.Millisecond
+
+// keyHelp goes after the status when the keys are being read.
+const keyHelp = "  [p]ause [n]ext [s]ave [q]uit [k]ill"
+
+// Options says what Run does with the frames it draws.
+type Options struct {
+	TUI       bool   // draw the board in the terminal
+	DumpEvery int    // turns between frames written to DumpDir, 0 writes none
+	DumpDir   string // directory the frames are written to
+}
+
+// Run draws the events into a framebuffer the way sdl.Run draws them into a window, for when there is no display.
+// If stdin is a terminal it also reads the same keys the window does, and keeps a status line at the bottom of the
+// terminal with the turn and alive count from the AliveCellsCount events.
+func Run(p gol.Params, events <-chan gol.Event, keyPresses chan<- rune, opts Options) {
+	f := NewFramebuffer(p.ImageWidth, p.ImageHeight)
+	var terminal *Terminal
+	if opts.TUI {
+		terminal = NewTerminal(os.Stdout)
+		defer terminal.Close()
+	}
+	keyboard, err := OpenKeyboard()
+	if err == nil {
+		defer keyboard.Close()
+		go keyboard.Read(keyPresses)
+	}
+
+	turn, alive := 0, 0
+	state := ""
+	status := func() string {
+		line := statusLine(turn, alive, state)
+		if keyboard != nil {
+			line += keyHelp
+		}
+		return line
+	}
+
+	var lastRender time.Time
+	render := func(force bool) {
+		if terminal != nil && (force || time.Since(lastRender) >= renderInterval) {
+			alive = f.CountPixels()
+			terminal.Render(f, status())
+			lastRender = time.Now()
+		}
+	}
+	// Without the board on screen, events are printed above a status line that is drawn over each time
+	printLine := func(line string) {
+		if keyboard == nil {
+			if line != "" {
+				fmt.Println(line)
+			}
+			return
+		}
+		if line != "" {
+			fmt.Print("\r\x1b[K", line, "\n")
+		}
+		fmt.Print("\r\x1b[K", status())
+	}
+	if keyboard != nil && terminal == nil {
+		defer fmt.Println()
+	}
+	dump := func() {
+		path, err := f.Dump(opts.DumpDir, turn)
+		if err != nil {
+			fmt.Println(err)
+		} else if terminal == nil {
+			printLine("Frame " + path + " written")
+		}
+	}
+
+	for event := range events {
+		switch e := event.(type) {
+		case gol.CellFlipped:
+			f.FlipPixel(e.Cell.X, e.Cell.Y)
+		case gol.TurnComplete:
+			turn = e.CompletedTurns
+			if opts.DumpEvery > 0 && turn%opts.DumpEvery == 0 {
+				dump()
+			}
+			render(false)
+		case gol.FinalTurnComplete:
+			turn = e.CompletedTurns
+			alive = len(e.Alive)
+			if opts.DumpEvery > 0 && turn%opts.DumpEvery != 0 {
+				dump()
+			}
+			state = "Finished"
+			render(true)
+			if terminal == nil {
+				printLine("")
+			}
+			// Carrying on until the channel is closed gives the final image time to be written before main exits
+		case gol.AliveCellsCount:
+			if terminal != nil {
+				break // the board's own count is newer
+			}
+			turn, alive = e.CompletedTurns, e.CellsCount
+			if keyboard == nil {
+				printLine(fmt.Sprintf("Completed Turns %-8v%v", event.GetCompletedTurns(), event))
+			} else {
+				printLine("")
+			}
+		default:
+			if len(event.String()) == 0 {
+				break
+			}
+			if e, ok := event.(gol.StateChange); ok {
+				state = e.String()
+			}
+			if terminal != nil {
+				// Printing would scroll the board away, so the event goes in the status line
+				state = event.String()
+				render(true)
+			} else {
+				printLine(fmt.Sprintf("Completed Turns %-8v%v", event.GetCompletedTurns(), event))
+			}
+		}
+	}
+	render(true)
+}
@@ -0,0 +1,105 @@
+package headless
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// quadrants holds a character for each 2x2 block of cells, indexed by a bit per cell:
+// 1 top left, 2 top right, 4 bottom left and 8 bottom right.
+var quadrants = []rune(" ▘▝▀▖▌▞▛▗▚▐▜▄▙▟█")
+
+// terminalSize returns the columns and rows of the terminal, or 80x24 if it can't be found.
+func terminalSize() (int, int) {
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err == nil {
+		var rows, columns int
+		if _, err := fmt.Sscan(string(out), &rows, &columns); err == nil && rows > 0 && columns > 0 {
+			return columns, rows
+		}
+	}
+	return 80, 24
+}
+
+// Terminal draws a framebuffer with Unicode block characters, two by two cells to a character.
+// Boards too big for the terminal are shrunk, a character then showing a cell as alive if any
+// of the cells it covers is.
+type Terminal struct {
+	out           *bufio.Writer
+	columns, rows int
+	started       bool
+}
+
+func NewTerminal(out io.Writer) *Terminal {
+	columns, rows := terminalSize()
+	return &Terminal{out: bufio.NewWriter(out), columns: columns, rows: rows}
+}
+
+// Render redraws the whole screen with the framebuffer and a status line under it.
+func (t *Terminal) Render(f *Framebuffer, status string) {
+	if !t.started {
+		// Clear the screen and hide the cursor
+		t.out.WriteString("\x1b[2J\x1b[?25l")
+		t.started = true
+	}
+	t.out.WriteString("\x1b[H")
+
+	// Each character is 2 cells wide and 2 high, one row is kept for the status line
+	scale := 1
+	for (f.Width+2*scale-1)/(2*scale) > t.columns || (f.Height+2*scale-1)/(2*scale) > t.rows-1 {
+		scale++
+	}
+	block := func(x, y int) bool {
+		for dy := 0; dy < scale; dy++ {
+			for dx := 0; dx < scale; dx++ {
+				if f.Alive(x*scale+dx, y*scale+dy) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	width := (f.Width + scale - 1) / scale
+	height := (f.Height + scale - 1) / scale
+	for y := 0; y < height; y += 2 {
+		for x := 0; x < width; x += 2 {
+			bits := 0
+			for i, alive := range []bool{block(x, y), block(x+1, y), block(x, y+1), block(x+1, y+1)} {
+				if alive {
+					bits |= 1 << uint(i)
+				}
+			}
+			t.out.WriteRune(quadrants[bits])
+		}
+		t.out.WriteString("\x1b[K\n")
+	}
+	if scale > 1 {
+		status = fmt.Sprintf("%s  (1:%d)", status, scale)
+	}
+	// cut by runes, cutting by bytes could split a character in two
+	if runes := []rune(status); len(runes) > t.columns {
+		status = string(runes[:t.columns])
+	}
+	t.out.WriteString(status + "\x1b[K\x1b[J")
+	t.out.Flush()
+}
+
+// Close puts the cursor back under the last frame.
+func (t *Terminal) Close() {
+	if t.started {
+		t.out.WriteString("\x1b[?25h\n")
+		t.out.Flush()
+	}
+}
+
+// statusLine is the line shown under the board.
+func statusLine(turn, alive int, state string) string {
+	return strings.TrimSpace(fmt.Sprintf("Turn %-8d Alive %-8d %s", turn, alive, state))
+}
@@ -3,10 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 	"runtime"
 
 	"uk.ac.bris.cs/gameoflife/gol"
+	"uk.ac.bris.cs/gameoflife/headless"
 	"uk.ac.bris.cs/gameoflife/sdl"
+	"uk.ac.bris.cs/gameoflife/stubs"
+	"uk.ac.bris.cs/gameoflife/util"
 )
 
 
@@ -45,17 +49,163 @@ func main() {
 		false,
 		"Disables the SDL window, so there is no visualisation during the tests.")
 
+	var headlessOptions headless.Options
+	flag.BoolVar(
+		&headlessOptions.TUI,
+		"tui",
+		false,
+		"With -noVis, draws the board in the terminal instead of a window. The keys work in the terminal with or without it.")
+
+	flag.IntVar(
+		&headlessOptions.DumpEvery,
+		"dump",
+		0,
+		"With -noVis, specify the number of turns between frames written to -dumpDir. Defaults to 0, no frames.")
+
+	flag.StringVar(
+		&headlessOptions.DumpDir,
+		"dumpDir",
+		"frames",
+		"Specify the directory -dump writes frames to. Defaults to frames.")
+
+	flag.StringVar(
+		&params.Rule,
+		"rule",
+		util.DefaultRule,
+		"Specify the Life-like rule in B/S notation, e.g. B36/S23 for HighLife. Defaults to B3/S23.")
+
+	flag.StringVar(
+		&params.Boundary,
+		"boundary",
+		util.Torus,
+		"Specify what lies past the edges of the world: torus, dead or klein. Defaults to torus.")
+
+	flag.StringVar(
+		&params.InputPath,
+		"in",
+		"",
+		"Specify a pgm or rle file to load instead of images/<w>x<h>.pgm. A pgm sets the size of the board.")
+
+	flag.StringVar(
+		&params.OutputDir,
+		"out",
+		"out",
+		"Specify the directory images are written to. Defaults to out.")
+
+	flag.StringVar(
+		&params.InputFormat,
+		"input",
+		"",
+		"Specify the input format, pgm (which also reads pbm) or rle. Defaults to the extension of -in or whichever of images/<w>x<h>.pgm and .rle exists.")
+
+	flag.IntVar(
+		&params.Threshold,
+		"threshold",
+		gol.DefaultThreshold,
+		"Specify the grey level from 0 to 255 at and above which a pgm pixel is an alive cell. Defaults to 128.")
+
+	flag.StringVar(
+		&params.OutputFormat,
+		"output",
+		"pgm",
+		"Specify the output format, pgm, rle or png. Defaults to pgm.")
+
+	flag.IntVar(
+		&params.Scale,
+		"scale",
+		1,
+		"Specify how many pixels wide each cell is in png and animation output. Defaults to 1.")
+
+	flag.IntVar(
+		&params.FrameEvery,
+		"frames",
+		0,
+		"Specify the number of turns between animation frames, observers write none. Defaults to 0, no animation.")
+
+	flag.StringVar(
+		&params.AnimationFormat,
+		"animation",
+		"gif",
+		"Specify the animation format, gif for an animated GIF or png for numbered frames. Defaults to gif.")
+
+	flag.IntVar(
+		&params.FrameRate,
+		"fps",
+		0,
+		"Specify the frames per second to show the game at, letting it run ahead of the window. Defaults to 0, every turn.")
+
+	flag.BoolVar(
+		&params.Observe,
+		"observe",
+		false,
+		"Watch the game running on the broker alongside its controller, without being able to pause, save or kill it.")
+
+	flag.IntVar(
+		&params.Game,
+		"game",
+		0,
+		"Specify the id of the game on the broker to control or observe. Defaults to 0, a new game, or with -observe the newest running game of this size.")
+
+	flag.BoolVar(
+		&params.Resume,
+		"resume",
+		false,
+		"Resume the game from the broker's newest checkpoint instead of starting a new one.")
+
 	flag.StringVar(
 		&gol.Server,
 		"server",
-		"127.0.0.1",
+		"127.0.0.1:8003",
 		"IP:port string to connect to as server")
 
 	flag.Parse()
 
+	if params.FrameRate < 0 || params.FrameRate > stubs.MaxFrameRate {
+		fmt.Printf("-fps has to be between 0 and %d\n", stubs.MaxFrameRate)
+		os.Exit(1)
+	}
+	if err := gol.CheckOutputFormat(params.OutputFormat); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := gol.CheckAnimationFormat(params.AnimationFormat); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if params.InputPath != "" {
+		width, height, err := gol.InputSize(params)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		params.ImageWidth, params.ImageHeight = width, height
+
+		// An RLE pattern's header names the rule it was made for, -rule wins if it was given
+		ruleGiven := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "rule" {
+				ruleGiven = true
+			}
+		})
+		rule, err := gol.InputRule(params)
+		if err != nil {
+			fmt.Println("Ignoring the pattern's rule:", err)
+		} else if rule != "" && !ruleGiven {
+			params.Rule = rule
+		} else if rule != "" {
+			given, _ := util.ParseRule(params.Rule)
+			header, _ := util.ParseRule(rule)
+			if given != header {
+				fmt.Printf("Running with -rule %s, the pattern was made for %s\n", params.Rule, rule)
+			}
+		}
+	}
+
 	fmt.Println("Threads:", params.Threads)
 	fmt.Println("Width:", params.ImageWidth)
 	fmt.Println("Height:", params.ImageHeight)
+	fmt.Println("Rule:", params.Rule)
+	fmt.Println("Boundary:", params.Boundary)
 
 	keyPresses := make(chan rune, 10)
 	events := make(chan gol.Event, 1000)
@@ -65,13 +215,6 @@ func main() {
 	if !(*noVis) {
 		sdl.Run(params, events, keyPresses)
 	} else {
-		complete := false
-		for !complete {
-			event := <-events
-			switch event.(type) {
-			case gol.FinalTurnComplete:
-				complete = true
-			}
-		}
+		headless.Run(params, events, keyPresses, headlessOptions)
 	}
-}
+}
\ No newline at end of file
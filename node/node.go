@@ -1,205 +1,743 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/rpc"
+	"os"
 	"sync"
+	"time"
 
 	"uk.ac.bris.cs/gameoflife/stubs"
 	"uk.ac.bris.cs/gameoflife/util"
 )
 
-var world [][]uint8
+// slice is a band of rows this node is evolving for the broker, a node can hold more than one
+type slice struct {
+	reports chan stubs.TurnReport
+	quit    chan bool
+	stopped bool
+	turns   int              //the last turn, the slice is forgotten once the broker has its report
+	turn    int              //the turn the slice has reached, rows for earlier turns are duplicates
+	world   util.BitBoard    //the slice at turn
+	above   map[int][]uint64 //rows from the neighbour above, by turn
+	below   map[int][]uint64 //rows from the neighbour below, by turn
+	up      stubs.Neighbour
+	down    stubs.Neighbour
+	sent    []sentHalo //edge rows sent since the broker's oldest snapshot, replayed to a neighbour's replacement
+	started int        //the last turn let through the pause gate, guarded by pauseMutex
+	game    int        //the broker's game the slice is part of, games are paused separately
+	startY  int        //the rows of the world the slice holds, the broker moves them to rebalance its nodes
+	endY    int
+}
+
+// pauseState is how far the slices of a paused game can go, games without one are running
+type pauseState struct {
+	runTo int //slices can still work up to and including this turn
+}
+
+type sentHalo struct {
+	turn  int
+	first []uint64
+	last  []uint64
+}
+
+var slices = make(map[int]*slice)
+var forgotten = make(map[int]bool) //slices that were stopped, calls for them that arrive late fail
 var mutex sync.Mutex
-var flippedCellChannels = make(chan []util.Cell)
-var aliveCellCountChannel = make(chan int)
-var turnChannel = make(chan int)
-var outHalo = make(chan stubs.HaloResponse)
-var inHalo = make(chan stubs.HaloResponse)
-var paused = make(chan int)
-var resume = make(chan int)
+var haloArrived = sync.NewCond(&mutex)
+var peers = make(map[string]*rpc.Client)
+var peersMutex sync.Mutex
+var lastHeartbeat time.Time
+var threads int    //goroutines per slice, 0 uses the client's -t
+var address string //the address this node registered with, halos sent to it are delivered directly
+var pauseMutex sync.Mutex
+var paused = make(map[int]*pauseState) //by game
+var gate = make(chan bool)             //closed and replaced whenever a game is paused, resumed or stepped
+var shutdown = make(chan int, 1)
+
+const registerInterval = 5 * time.Second
+const shutdownGrace = 500 * time.Millisecond
+const haloTimeout = time.Second
+
+// a node whose broker has not sent a heartbeat for this long abandons its slices
+const brokerTimeout = 5 * time.Second
+
+// reports are buffered so a slice is not held up waiting for the broker to collect them
+const reportBuffer = 16
 
 type Node struct{}
 
-func calculateNeighbours(width, x, y int, haloWorld [][]uint8) int {
-	height := len(haloWorld)
-	neighbours := 0
-	for i := -1; i <= 1; i++ {
-		for j := -1; j <= 1; j++ {
-			if i != 0 || j != 0 {
-				h := (y + height + i) % height
-				w := (x + width + j) % width
-				if haloWorld[h][w] == 255 {
-					neighbours++
-				}
-			}
+// Returns the words of a row shifted so bit x holds the cell to the left of x, and the cell to the right of x.
+// With wrap the ends of the row are next to each other, without it the cells past them are dead.
+func shiftedRow(width int, wrap bool, i int, row []uint64) (uint64, uint64) {
+	last := len(row) - 1
+	var left, right uint64
+	if i == 0 {
+		if wrap {
+			left = row[last] >> uint((width-1)%64) & 1
+		}
+	} else {
+		left = row[i-1] >> 63
+	}
+	if i == last {
+		if wrap {
+			right = (row[0] & 1) << uint((width-1)%64)
 		}
+	} else {
+		right = row[i+1] << 63
 	}
-	return neighbours
+	return row[i]<<1 | left, row[i]>>1 | right
 }
 
-func calculateNextState(height, width int, haloWorld [][]uint8) [][]uint8 {
+// Adds three words bit by bit, returning the sum and carry bits
+func fullAdd(a, b, c uint64) (uint64, uint64) {
+	return a ^ b ^ c, a&b | c&(a^b)
+}
 
-	newWorld := makeMatrix(height, width)
+// Returns the bits whose neighbour count, held as four bit planes, is n
+func countIs(n uint, ones, twos, fours, eights uint64) uint64 {
+	match := ^uint64(0)
+	for bit, plane := range [4]uint64{ones, twos, fours, eights} {
+		if n>>uint(bit)&1 == 1 {
+			match &= plane
+		} else {
+			match &^= plane
+		}
+	}
+	return match
+}
 
-	for c0, c2 := 1, 0; c0 < height+1; c0, c2 = c0+1, c2+1 {
-		for r := 0; r < width; r++ {
+// Works out the next state of a row 64 cells at a time, counting the eight neighbours of every bit in parallel
+func calculateRow(rule util.Rule, width int, wrap bool, up, row, down, newRow []uint64) {
+	for i := range row {
+		upLeft, upRight := shiftedRow(width, wrap, i, up)
+		left, right := shiftedRow(width, wrap, i, row)
+		downLeft, downRight := shiftedRow(width, wrap, i, down)
 
-			neighbours := calculateNeighbours(width, r, c0, haloWorld)
-			currentState := haloWorld[c0][r]
+		s0, c0 := fullAdd(upLeft, up[i], upRight)
+		s1, c1 := fullAdd(left, right, downLeft)
+		s2, c2 := down[i]^downRight, down[i]&downRight
+		ones, c3 := fullAdd(s0, s1, s2)
+		t, fours0 := fullAdd(c0, c1, c2)
+		twos, fours1 := t^c3, t&c3
+		fours, eights := fours0^fours1, fours0&fours1
 
-			if currentState == 255 {
-				if neighbours == 2 || neighbours == 3 {
-					newWorld[c2][r] = 255
-				}
+		var born, survives uint64
+		for n := uint(0); n <= 8; n++ {
+			if (rule.Birth|rule.Survive)>>n&1 == 0 {
+				continue
+			}
+			count := countIs(n, ones, twos, fours, eights)
+			if rule.Birth>>n&1 == 1 {
+				born |= count
 			}
-			if currentState == 0 {
-				if neighbours == 3 {
-					newWorld[c2][r] = 255
-				}
+			if rule.Survive>>n&1 == 1 {
+				survives |= count
 			}
 		}
+		newRow[i] = born&^row[i] | survives&row[i]
 	}
-	return newWorld
+	newRow[len(newRow)-1] &= util.LastWordMask(width)
 }
 
-func makeMatrix(height, width int) [][]uint8 {
-	matrix := make([][]uint8, height)
-	for i := range matrix {
-		matrix[i] = make([]uint8, width)
+// Splits the slice's rows between a number of goroutines, each writing its own rows of the new world
+func calculateNextState(rule util.Rule, wrap bool, threads int, above, below []uint64, world util.BitBoard) util.BitBoard {
+
+	newWorld := util.NewBitBoard(world.Width, world.Height)
+	height := world.Height
+
+	row := func(y int) []uint64 {
+		if y < 0 {
+			return above
+		}
+		if y == height {
+			return below
+		}
+		return world.Row(y)
 	}
-	return matrix
-}
 
-func findAliveCellCount(height, width int, world [][]uint8) int {
-	var count = 0
-	for col := 0; col < height; col++ {
-		for row := 0; row < width; row++ {
-			if world[col][row] == 255 {
-				count++
+	if threads < 1 {
+		threads = 1
+	}
+	if threads > height {
+		threads = height
+	}
+	var wg sync.WaitGroup
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func(startY, endY int) {
+			defer wg.Done()
+			for y := startY; y < endY; y++ {
+				calculateRow(rule, world.Width, wrap, row(y-1), row(y), row(y+1), newWorld.Row(y))
 			}
+		}(t*height/threads, (t+1)*height/threads)
+	}
+	wg.Wait()
+	return newWorld
+}
+
+// Returns the slice with the given id, creating it when a call from the broker arrives before ProcessSlice does
+func getSlice(id int) *slice {
+	mutex.Lock()
+	defer mutex.Unlock()
+	sl, ok := slices[id]
+	if !ok {
+		sl = &slice{
+			reports: make(chan stubs.TurnReport, reportBuffer),
+			quit:    make(chan bool),
+			above:   make(map[int][]uint64),
+			below:   make(map[int][]uint64),
+		}
+		if forgotten[id] {
+			stop(sl)
+			return sl
 		}
+		slices[id] = sl
+		// the broker starts heartbeating a little after it hands out slices
+		lastHeartbeat = time.Now()
 	}
-	return count
+	return sl
 }
 
-func flippedCells(height, width, startY int, initial, nextState [][]uint8) []util.Cell {
-	var flipped []util.Cell
-	for col := 0; col < height; col++ {
-		for row := 0; row < width; row++ {
-			if initial[col][row] != nextState[col][row] {
-				flipped = append(flipped, util.Cell{X: row, Y: startY + col})
-			}
+// Blocks while the slice's game is paused and turn is past runTo, returns false if the slice is stopped while waiting
+func waitIfPaused(sl *slice, turn int) bool {
+	pauseMutex.Lock()
+	defer pauseMutex.Unlock()
+	for paused[sl.game] != nil && turn > paused[sl.game].runTo {
+		changed := gate
+		pauseMutex.Unlock()
+		select {
+		case <-changed:
+		case <-sl.quit:
+			pauseMutex.Lock()
+			return false
 		}
+		pauseMutex.Lock()
 	}
-	return flipped
+	sl.started = turn
+	return true
 }
 
-func (s *Node) ProcessSlice(req stubs.NodeRequest, res *stubs.NodeResponse) (err error) {
-	world = req.CurrentWorld
-	for turn := 1; turn < req.Turns+1; turn++ {
+// Wakes every slice waiting at the pause gate to look again, pauseMutex must be held
+func openGate() {
+	close(gate)
+	gate = make(chan bool)
+}
+
+// Reverses a row so cell x ends up at width-1-x
+func mirror(width int, row []uint64) []uint64 {
+	mirrored := make([]uint64, len(row))
+	for x := 0; x < width; x++ {
+		if row[x/64]>>uint(x%64)&1 == 1 {
+			y := width - 1 - x
+			mirrored[y/64] |= 1 << uint(y%64)
+		}
+	}
+	return mirrored
+}
 
-		var nextWorld [][]uint8
-		var neighboursWorld [][]uint8
+// Returns what a slice on the top or bottom edge of the world sees past it, given the row from across the edge
+func acrossEdge(boundary string, width int, row []uint64) []uint64 {
+	switch boundary {
+	case util.Dead:
+		return make([]uint64, len(row))
+	case util.Klein:
+		return mirror(width, row)
+	}
+	return row
+}
 
-		select {
-		case halo := <-inHalo:
-			neighboursWorld = append(neighboursWorld, halo.FirstHalo)
-			neighboursWorld = append(neighboursWorld, world...)
-			neighboursWorld = append(neighboursWorld, halo.LastHalo)
+// Waits for the neighbour's row a slice needs to work out its next turn
+func receive(sl *slice, rows map[int][]uint64, turn int) ([]uint64, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for {
+		if sl.stopped {
+			return nil, false
 		}
+		if row, ok := rows[turn]; ok {
+			delete(rows, turn)
+			return row, true
+		}
+		haloArrived.Wait()
+	}
+}
+
+// Stores a row sent by a neighbour, rows for turns already passed come from a replacement redoing them and are dropped,
+// as are rows for a stopped slice
+func deliver(req stubs.HaloRequest) {
+	sl := getSlice(req.Slice)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if sl.stopped || req.Turn < sl.turn {
+		return
+	}
+	if req.FromAbove {
+		sl.above[req.Turn] = req.Halo
+	} else {
+		sl.below[req.Turn] = req.Halo
+	}
+	haloArrived.Broadcast()
+}
+
+// Returns a connection to another node, reusing it between turns
+func peer(addr string) (*rpc.Client, error) {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+	if client, ok := peers[addr]; ok {
+		return client, nil
+	}
+	conn, err := net.DialTimeout("tcp", addr, haloTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client := rpc.NewClient(conn)
+	peers[addr] = client
+	return client, nil
+}
+
+func dropPeer(addr string, client *rpc.Client) {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+	if peers[addr] == client {
+		delete(peers, addr)
+		client.Close()
+	}
+}
+
+// Sends an edge row to a neighbouring slice. A neighbour that can't be reached is left for the broker to
+// replace, the row is kept in the slice's sent rows and handed to the replacement.
+func sendHalo(to stubs.Neighbour, req stubs.HaloRequest) {
+	if to.Address == address {
+		deliver(req)
+		return
+	}
+	client, err := peer(to.Address)
+	if err != nil {
+		fmt.Println("Could not reach neighbouring node:", err)
+		return
+	}
+	call := client.Go(stubs.SendHaloToNode, req, new(stubs.EmptyResponse), nil)
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-time.After(haloTimeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		fmt.Println("Could not send halo to neighbouring node:", err)
+		dropPeer(to.Address, client)
+	}
+}
 
-		worldHeight := len(world)
-		worldWidth := req.Width
-		nextWorld = calculateNextState(worldHeight, worldWidth, neighboursWorld)
+// Records the slice's new edge rows and sends them to the neighbours above and below.
+// Sharing a turn again, after cells were edited, replaces the rows recorded for it.
+func shareEdges(sl *slice, turn int, world util.BitBoard) {
+	first, last := world.Row(0), world.Row(world.Height-1)
+	mutex.Lock()
+	sl.turn = turn
+	sl.world = world
+	edges := sentHalo{turn: turn, first: first, last: last}
+	if n := len(sl.sent); n > 0 && sl.sent[n-1].turn == turn {
+		sl.sent[n-1] = edges
+	} else {
+		sl.sent = append(sl.sent, edges)
+	}
+	up, down := sl.up, sl.down
+	mutex.Unlock()
+	sendHalo(up, stubs.HaloRequest{Slice: up.Slice, Turn: turn, FromAbove: false, Halo: first})
+	sendHalo(down, stubs.HaloRequest{Slice: down.Slice, Turn: turn, FromAbove: true, Halo: last})
+}
 
+func (s *Node) ProcessSlice(req stubs.NodeRequest, res *stubs.NodeResponse) (err error) {
+	sl := getSlice(req.Slice)
+	finished := false
+	defer func() {
 		mutex.Lock()
+		if !finished {
+			forget(req.Slice, sl)
+		}
+		mutex.Unlock()
+	}()
 
-		flippedCellChannels <- flippedCells(worldHeight, worldWidth, req.StartY, world, nextWorld)
-		world = nextWorld
-		aliveCellCountChannel <- findAliveCellCount(worldHeight, worldWidth, world)
-		outHalo <- stubs.HaloResponse{FirstHalo: world[0], LastHalo: world[len(nextWorld)-1]}
-		turnChannel <- turn
+	rule, err := util.ParseRule(req.Rule)
+	if err != nil {
+		return err
+	}
+	err = util.CheckBoundary(req.Boundary)
+	if err != nil {
+		return err
+	}
+	world := req.CurrentWorld
+	sliceThreads := req.Threads
+	if threads > 0 {
+		sliceThreads = threads
+	}
+
+	mutex.Lock()
+	// a Redirect that got here first has newer neighbours than the request
+	if sl.up.Address == "" {
+		sl.up = req.Up
+	}
+	if sl.down.Address == "" {
+		sl.down = req.Down
+	}
+	sl.turns = req.Turns
+	sl.game = req.Game
+	sl.startY, sl.endY = req.StartY, req.EndY
+	sl.turn = req.StartTurn
+	sl.world = world
+	sl.sent = []sentHalo{{turn: req.StartTurn, first: world.Row(0), last: world.Row(world.Height - 1)}}
+	for i, row := range req.FromAbove {
+		sl.above[req.StartTurn+i] = row
+	}
+	for i, row := range req.FromBelow {
+		sl.below[req.StartTurn+i] = row
+	}
+	mutex.Unlock()
 
+	pauseMutex.Lock()
+	sl.started = req.StartTurn
+	pauseMutex.Unlock()
+
+	for turn := req.StartTurn + 1; turn < req.Turns+1; turn++ {
+		if !waitIfPaused(sl, turn) {
+			return
+		}
+		//cells may have been edited, or rows moved, while the slice was paused
+		mutex.Lock()
+		world = sl.world
+		startY, endY := sl.startY, sl.endY
 		mutex.Unlock()
 
-		select {
-		case  <- paused:
-			<-resume
-		default:
-			break
+		firstHalo, ok := receive(sl, sl.above, turn-1)
+		if !ok {
+			return
+		}
+		lastHalo, ok := receive(sl, sl.below, turn-1)
+		if !ok {
+			return
 		}
+		if startY == 0 {
+			firstHalo = acrossEdge(req.Boundary, world.Width, firstHalo)
+		}
+		if endY == req.ImageHeight {
+			lastHalo = acrossEdge(req.Boundary, world.Width, lastHalo)
+		}
+
+		began := time.Now()
+		nextWorld := calculateNextState(rule, req.Boundary != util.Dead, sliceThreads, firstHalo, lastHalo, world)
+		busy := time.Since(began)
 
+		if turn < req.Turns {
+			shareEdges(sl, turn, nextWorld)
+		}
+
+		if turn >= req.ReportFrom {
+			report := stubs.TurnReport{
+				Turn:            turn,
+				NumOfAliveCells: nextWorld.Count(),
+				FlippedCells:    nextWorld.Diff(world, startY),
+				Busy:            busy,
+			}
+			if turn == req.Turns || (req.SnapshotInterval > 0 && turn%req.SnapshotInterval == 0) {
+				report.WorldSlice = nextWorld
+			}
+			select {
+			case sl.reports <- report:
+			case <-sl.quit:
+				return
+			}
+		}
+
+		world = nextWorld
 	}
+	finished = true
 	res.WorldSlice = world
 	return
 }
 
-func (s *Node) GetFlippedCells(req stubs.EmptyRequest, res *stubs.FlippedCellResponse) (err error) {
+// GetTurnReport blocks until the slice has finished its next turn
+func (s *Node) GetTurnReport(req stubs.SliceRequest, res *stubs.TurnReport) (err error) {
+	sl := getSlice(req.Slice)
+	mutex.Lock()
+	kept := 0
+	for kept < len(sl.sent) && sl.sent[kept].turn < req.KeepFrom {
+		kept++
+	}
+	sl.sent = sl.sent[kept:]
+	mutex.Unlock()
 	select {
-	case flipped := <-flippedCellChannels:
-		res.FlippedCells = flipped
+	case report := <-sl.reports:
+		*res = report
+		if report.Turn == sl.turns {
+			mutex.Lock()
+			if slices[req.Slice] == sl {
+				delete(slices, req.Slice)
+			}
+			mutex.Unlock()
+		}
+	case <-sl.quit:
+		return fmt.Errorf("slice %d was stopped", req.Slice)
 	}
 	return
 }
 
-func (s *Node) GetTurnAndAliveCell(req stubs.EmptyRequest, res *stubs.TurnResponse) (err error) {
-	for i := 0; i < 2; i++ {
-		select {
-		case turn := <-turnChannel:
-			res.Turn = turn
-		case count := <-aliveCellCountChannel:
-			res.NumOfAliveCells = count
+// SendHaloToNode is how neighbouring nodes hand a slice their edge rows
+func (s *Node) SendHaloToNode(req stubs.HaloRequest, res *stubs.EmptyResponse) (err error) {
+	deliver(req)
+	return
+}
+
+// Redirect points a slice at the node that replaced a dead neighbour and returns the rows it sent that
+// neighbour from req.From on, so the replacement can catch up
+func (s *Node) Redirect(req stubs.RedirectRequest, res *stubs.RedirectResponse) (err error) {
+	sl := getSlice(req.Slice)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if sl.stopped {
+		return fmt.Errorf("slice %d was stopped", req.Slice)
+	}
+	if req.Up {
+		sl.up = req.Neighbour
+	} else {
+		sl.down = req.Neighbour
+	}
+	for _, sent := range sl.sent {
+		if sent.turn < req.From {
+			continue
+		}
+		if req.Up {
+			res.Halos = append(res.Halos, sent.first)
+		} else {
+			res.Halos = append(res.Halos, sent.last)
 		}
 	}
+	if len(sl.sent) == 0 || sl.sent[0].turn > req.From {
+		return fmt.Errorf("slice %d no longer has its rows from turn %d", req.Slice, req.From)
+	}
 	return
 }
 
-func (s *Node) SendHaloToBroker(req stubs.EmptyRequest, res *stubs.HaloResponse) (err error) {
-	select {
-	case halo := <-outHalo:
-		res.FirstHalo = halo.FirstHalo
-		res.LastHalo = halo.LastHalo
+// PauseAndResumeNode pauses the node's slices of req.Game once they finish the turn they are on, replying with the
+// furthest turn any of them has started. RUNTO then lets them all carry on up to req.Turn, which is how the broker
+// lines every slice up on the same turn and steps them forward while paused. Slices of other games carry on.
+func (s *Node) PauseAndResumeNode(req stubs.PauseRequest, res *stubs.PauseResponse) (err error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	pauseMutex.Lock()
+	defer pauseMutex.Unlock()
+	switch req.Command {
+	case "PAUSE":
+		furthest := 0
+		for _, sl := range slices {
+			if !sl.stopped && sl.game == req.Game && sl.started > furthest {
+				furthest = sl.started
+			}
+		}
+		if paused[req.Game] == nil {
+			paused[req.Game] = &pauseState{runTo: furthest}
+		}
+		res.Turn = paused[req.Game].runTo
+	case "RUNTO":
+		if paused[req.Game] == nil {
+			paused[req.Game] = &pauseState{}
+		}
+		paused[req.Game].runTo = req.Turn
+		res.Turn = req.Turn
+	case "RESUME":
+		delete(paused, req.Game)
+	}
+	openGate()
+	return
+}
+
+// EditCells flips cells of a slice paused on req.Turn, then sends its edge rows again as they may have changed
+func (s *Node) EditCells(req stubs.EditRequest, res *stubs.EmptyResponse) (err error) {
+	sl := getSlice(req.Slice)
+	mutex.Lock()
+	pauseMutex.Lock()
+	waiting := paused[sl.game] != nil && paused[sl.game].runTo == req.Turn
+	pauseMutex.Unlock()
+	if sl.stopped || !waiting || sl.turn != req.Turn {
+		mutex.Unlock()
+		return fmt.Errorf("slice %d is not paused on turn %d", req.Slice, req.Turn)
+	}
+	world := sl.world.Copy()
+	for _, cell := range req.Cells {
+		world.Flip(cell.X, cell.Y)
+	}
+	mutex.Unlock()
+	shareEdges(sl, req.Turn, world)
+	return
+}
+
+// ResizeSlice moves the edges of a slice paused on req.Turn, adding the rows it takes from its neighbours and dropping
+// the ones it gives them, then sends its edge rows again as they have changed
+func (s *Node) ResizeSlice(req stubs.ResizeRequest, res *stubs.EmptyResponse) (err error) {
+	sl := getSlice(req.Slice)
+	mutex.Lock()
+	pauseMutex.Lock()
+	waiting := paused[sl.game] != nil && paused[sl.game].runTo == req.Turn
+	pauseMutex.Unlock()
+	if sl.stopped || !waiting || sl.turn != req.Turn {
+		mutex.Unlock()
+		return fmt.Errorf("slice %d is not paused on turn %d", req.Slice, req.Turn)
+	}
+	keepFrom, keepTo := req.Kept(sl.startY, sl.endY)
+	if req.Top.Height != keepFrom-req.StartY || req.Bottom.Height != req.EndY-keepTo {
+		mutex.Unlock()
+		return fmt.Errorf("slice %d cannot move from rows %d-%d to %d-%d", req.Slice, sl.startY, sl.endY, req.StartY, req.EndY)
+	}
+	var bands []util.BitBoard
+	if req.Top.Height > 0 {
+		bands = append(bands, req.Top)
+	}
+	if keepTo > keepFrom {
+		bands = append(bands, sl.world.Rows(keepFrom-sl.startY, keepTo-sl.startY))
+	}
+	if req.Bottom.Height > 0 {
+		bands = append(bands, req.Bottom)
 	}
+	world := util.JoinBitBoards(bands)
+	sl.startY, sl.endY = req.StartY, req.EndY
+	mutex.Unlock()
+	shareEdges(sl, req.Turn, world)
 	return
 }
 
-func (s *Node) SendHaloToNode(haloFromBroker stubs.HaloResponse, res *stubs.EmptyResponse) (err error) {
-	inHalo <- haloFromBroker
+// Closes the quit channel of a slice and lets go of its rows, mutex must be held
+func stop(sl *slice) {
+	if !sl.stopped {
+		sl.stopped = true
+		close(sl.quit)
+		haloArrived.Broadcast()
+		sl.world = util.BitBoard{}
+		sl.above = make(map[int][]uint64)
+		sl.below = make(map[int][]uint64)
+		sl.sent = nil
+		for len(sl.reports) > 0 {
+			<-sl.reports
+		}
+	}
+}
+
+// Stops a slice and drops it from the node, its id is remembered so a GetTurnReport that comes in late fails
+// rather than waiting for ever. mutex must be held.
+func forget(id int, sl *slice) {
+	stop(sl)
+	if slices[id] == sl {
+		delete(slices, id)
+	}
+	forgotten[id] = true
+}
+
+// StopSlice abandons a slice, used when the broker gives up on a game or moves the slice
+func (s *Node) StopSlice(req stubs.SliceRequest, res *stubs.EmptyResponse) (err error) {
+	sl := getSlice(req.Slice)
+	mutex.Lock()
+	forget(req.Slice, sl)
+	mutex.Unlock()
 	return
 }
 
-func (s *Node) PauseAndResumeNode(req stubs.PauseRequest, res *stubs.EmptyResponse) (err error) {
-	if req.Command == "PAUSE" {
-		paused <- 1
+// Shutdown stops every slice on the node and exits it
+func (s *Node) Shutdown(req stubs.EmptyRequest, res *stubs.EmptyResponse) (err error) {
+	mutex.Lock()
+	for _, sl := range slices {
+		stop(sl)
 	}
-	if req.Command == "RESUME"{
-		resume <- 1
+	mutex.Unlock()
+	fmt.Println("Shutting down")
+	//the node is already on its way out if it has been told before
+	select {
+	case shutdown <- 0:
+	default:
 	}
 	return
 }
 
-func (s *Node) GetNode(req stubs.EmptyRequest, res *stubs.NodeResponse) (err error) {
+// Heartbeat lets the broker check this node is still alive
+func (s *Node) Heartbeat(req stubs.EmptyRequest, res *stubs.EmptyResponse) (err error) {
 	mutex.Lock()
-	res.WorldSlice = world
+	lastHeartbeat = time.Now()
 	mutex.Unlock()
 	return
 }
 
+// Abandons every slice once the broker stops heartbeating, so a broker that is restarted finds the node idle
+func watchBroker() {
+	for range time.Tick(time.Second) {
+		mutex.Lock()
+		if len(slices) > 0 && time.Since(lastHeartbeat) > brokerTimeout {
+			fmt.Println("Lost the broker, stopping", len(slices), "slices")
+			for id, sl := range slices {
+				forget(id, sl)
+			}
+			pauseMutex.Lock()
+			paused = make(map[int]*pauseState)
+			openGate()
+			pauseMutex.Unlock()
+		}
+		mutex.Unlock()
+	}
+}
+
+// Announces this node to the broker so it is included in the next game
+func registerWithBroker(brokerAddr, nodeAddr string) {
+	for {
+		register(brokerAddr, nodeAddr)
+		// keep announcing so a broker that restarted (e.g. to resume from a checkpoint) finds this node again
+		time.Sleep(registerInterval)
+	}
+}
+
+func register(brokerAddr, nodeAddr string) {
+	broker, err := rpc.Dial("tcp", brokerAddr)
+	if err != nil {
+		fmt.Println("Could not reach broker:", err)
+		return
+	}
+	defer broker.Close()
+	err = broker.Call(stubs.RegisterWorker, stubs.RegisterRequest{Address: nodeAddr}, &stubs.EmptyResponse{})
+	if err != nil {
+		fmt.Println("Could not register with broker:", err)
+	}
+}
+
 func main() {
 	pAddr := flag.String("port", "8030", "Port to listen on")
+	ipAddr := flag.String("ip", "localhost", "IP the broker can reach this node on")
+	brokerAddr := flag.String("broker", "localhost:8003", "IP:port of the broker to register with")
+	flag.IntVar(&threads, "threads", 0, "Goroutines to split each slice between, 0 uses the client's -t")
 	flag.Parse()
 	rpc.Register(&Node{})
-	listener, _ := net.Listen("tcp", ":"+*pAddr)
+	listener, err := net.Listen("tcp", ":"+*pAddr)
+	util.Check(err)
+
+	address = *ipAddr + ":" + *pAddr
+	go registerWithBroker(*brokerAddr, address)
+	go watchBroker()
 
-	defer func(listener net.Listener) {
-		err := listener.Close()
-		if err != nil {
-			fmt.Println("Error in listerner")
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go rpc.ServeConn(conn)
 		}
-	}(listener)
-	rpc.Accept(listener)
+	}()
 
+	code := <-shutdown
+	err = listener.Close()
+	if err != nil {
+		fmt.Println("Error in listerner")
+	}
+	// give the reply to Shutdown time to reach the broker
+	time.Sleep(shutdownGrace)
+	os.Exit(code)
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"uk.ac.bris.cs/gameoflife/stubs"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// randomBoard fills about a third of a board's cells
+func randomBoard(random *rand.Rand, width, height int) util.BitBoard {
+	board := util.NewBitBoard(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			board.Set(x, y, random.Intn(3) == 0)
+		}
+	}
+	return board
+}
+
+// naiveStep works a turn out one cell at a time, as the kernel should
+func naiveStep(rule util.Rule, boundary string, world util.BitBoard) util.BitBoard {
+	width, height := world.Width, world.Height
+	alive := func(x, y int) bool {
+		if y < 0 || y >= height {
+			if boundary == util.Dead {
+				return false
+			}
+			if boundary == util.Klein {
+				x = width - 1 - x
+			}
+			y = (y + height) % height
+		}
+		if x < 0 || x >= width {
+			if boundary == util.Dead {
+				return false
+			}
+			x = (x + width) % width
+		}
+		return world.Alive(x, y)
+	}
+	next := util.NewBitBoard(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			n := uint(0)
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					if (dx != 0 || dy != 0) && alive(x+dx, y+dy) {
+						n++
+					}
+				}
+			}
+			if world.Alive(x, y) {
+				next.Set(x, y, rule.Survive>>n&1 == 1)
+			} else {
+				next.Set(x, y, rule.Birth>>n&1 == 1)
+			}
+		}
+	}
+	return next
+}
+
+func TestFullAdd(t *testing.T) {
+	for a := uint64(0); a < 2; a++ {
+		for b := uint64(0); b < 2; b++ {
+			for c := uint64(0); c < 2; c++ {
+				sum, carry := fullAdd(a, b, c)
+				if total := a + b + c; sum != total&1 || carry != total>>1 {
+					t.Errorf("fullAdd(%d, %d, %d) = %d, %d, want %d, %d", a, b, c, sum, carry, total&1, total>>1)
+				}
+			}
+		}
+	}
+}
+
+func TestCountIs(t *testing.T) {
+	// bit k of the planes holds the count k
+	var ones, twos, fours, eights uint64
+	for k := uint(0); k <= 8; k++ {
+		ones |= uint64(k&1) << k
+		twos |= uint64(k>>1&1) << k
+		fours |= uint64(k>>2&1) << k
+		eights |= uint64(k>>3&1) << k
+	}
+	for n := uint(0); n <= 8; n++ {
+		if got := countIs(n, ones, twos, fours, eights) & 0x1FF; got != 1<<n {
+			t.Errorf("countIs(%d) = %09b, want %09b", n, got, uint64(1)<<n)
+		}
+	}
+}
+
+func TestShiftedRow(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for _, width := range []int{1, 63, 64, 100, 129} {
+		for _, wrap := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%d-wrap=%v", width, wrap), func(t *testing.T) {
+				row := randomBoard(random, width, 1)
+				cell := func(x int) uint64 {
+					if x < 0 || x >= width {
+						if !wrap {
+							return 0
+						}
+						x = (x + width) % width
+					}
+					if row.Alive(x, 0) {
+						return 1
+					}
+					return 0
+				}
+				for i := range row.Words {
+					left, right := shiftedRow(width, wrap, i, row.Words)
+					for bit := 0; bit < 64 && 64*i+bit < width; bit++ {
+						x := 64*i + bit
+						if left>>uint(bit)&1 != cell(x-1) || right>>uint(bit)&1 != cell(x+1) {
+							t.Fatalf("cell %d sees %d to its left and %d to its right, want %d and %d",
+								x, left>>uint(bit)&1, right>>uint(bit)&1, cell(x-1), cell(x+1))
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCalculateRow(t *testing.T) {
+	// B0 rules bring every dead cell with no neighbours to life, the bits past the width have to stay 0
+	rule, _ := util.ParseRule("B0/S8")
+	for _, width := range []int{64, 100, 129} {
+		up, row, down := make([]uint64, util.RowWords(width)), make([]uint64, util.RowWords(width)), make([]uint64, util.RowWords(width))
+		newRow := make([]uint64, util.RowWords(width))
+		calculateRow(rule, width, true, up, row, down, newRow)
+		want := util.NewBitBoard(width, 1)
+		for x := 0; x < width; x++ {
+			want.Set(x, 0, true)
+		}
+		for i := range newRow {
+			if newRow[i] != want.Words[i] {
+				t.Errorf("width %d: word %d is %x, want %x", width, i, newRow[i], want.Words[i])
+			}
+		}
+	}
+}
+
+func TestCalculateNextState(t *testing.T) {
+	random := rand.New(rand.NewSource(2))
+	rules := []string{util.DefaultRule, "B36/S23", "B2/S", "B0/S8", "B0123478/S34678"}
+	for _, width := range []int{64, 100, 129} {
+		for _, boundary := range []string{util.Torus, util.Dead, util.Klein} {
+			for _, ruleString := range rules {
+				rule, err := util.ParseRule(ruleString)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, threads := range []int{1, 4} {
+					name := fmt.Sprintf("%dx37-%s-%s-%d", width, boundary, ruleString, threads)
+					t.Run(name, func(t *testing.T) {
+						world := randomBoard(random, width, 37)
+						want := world.Copy()
+						for turn := 1; turn <= 4; turn++ {
+							// the whole world as one slice, its halos come from across its own edges
+							above := acrossEdge(boundary, width, world.Row(world.Height-1))
+							below := acrossEdge(boundary, width, world.Row(0))
+							world = calculateNextState(rule, boundary != util.Dead, threads, above, below, world)
+							want = naiveStep(rule, boundary, want)
+							if diff := world.Diff(want, 0); len(diff) > 0 {
+								t.Fatalf("turn %d: %d cells differ, the first is %v", turn, len(diff), diff[0])
+							}
+						}
+					})
+				}
+			}
+		}
+	}
+}
+
+func TestStopSlice(t *testing.T) {
+	node := &Node{}
+	getSlice(1)
+	if err := node.StopSlice(stubs.SliceRequest{Slice: 1}, &stubs.EmptyResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(slices) != 0 {
+		t.Errorf("%d slices are still on the node", len(slices))
+	}
+
+	// a report asked for after the slice stopped fails rather than waiting for a slice that never runs
+	failed := make(chan error)
+	go func() {
+		failed <- node.GetTurnReport(stubs.SliceRequest{Slice: 1}, new(stubs.TurnReport))
+	}()
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Errorf("GetTurnReport returned a report for a stopped slice")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("GetTurnReport for a stopped slice is still waiting")
+	}
+	if len(slices) != 0 {
+		t.Errorf("GetTurnReport brought the stopped slice back")
+	}
+}
@@ -0,0 +1,239 @@
+package sdl
+
+import "math"
+
+// ColourMode is how cells are coloured in the window, 'c' moves on to the next one.
+type ColourMode int
+
+const (
+	// Plain shows alive cells white and dead cells black.
+	Plain ColourMode = iota
+	// Age colours alive cells by how many turns they have been alive, from white when born through yellow
+	// and red to purple for cells that have not changed in a long time.
+	Age
+	// Trails shows alive cells white and fades cells that died recently from blue to black.
+	Trails
+	// Heatmap colours every cell by how often it has flipped since the window opened, still regions stay
+	// black and the busiest ones glow white.
+	Heatmap
+	colourModes
+)
+
+func (m ColourMode) String() string {
+	switch m {
+	case Plain:
+		return "plain"
+	case Age:
+		return "age"
+	case Trails:
+		return "trails"
+	case Heatmap:
+		return "heatmap"
+	}
+	return "unknown"
+}
+
+// oldAge is the age in turns at which cells reach the last colour of agePalette.
+const oldAge = 256
+
+// trailLength is how many turns it takes a dead cell's trail to fade out.
+const trailLength = 32
+
+// rgb is a colour in a palette.
+type rgb struct{ r, g, b float64 }
+
+// flipped is the cells, by index into the board, that flipped on a turn.
+type flipped struct {
+	turn  int
+	cells []int32
+}
+
+var agePalette = []rgb{{255, 255, 255}, {255, 230, 60}, {255, 120, 0}, {210, 20, 40}, {110, 20, 140}}
+
+var trailPalette = []rgb{{60, 120, 255}, {20, 30, 120}, {0, 0, 0}}
+
+var heatPalette = []rgb{{0, 0, 0}, {120, 0, 0}, {230, 60, 0}, {255, 200, 0}, {255, 255, 255}}
+
+// ageColours and trailColours are the colours of cells by how many turns ago they flipped, worked out once
+// rather than for every cell.
+var ageColours = colourTable(oldAge+1, func(since int) rgb {
+	return gradient(agePalette, math.Log1p(float64(since))/math.Log1p(oldAge))
+})
+
+var trailColours = colourTable(trailLength, func(since int) rgb {
+	return gradient(trailPalette, float64(since)/trailLength)
+})
+
+// colourTable lists the colours of n values.
+func colourTable(n int, colour func(int) rgb) []rgb {
+	table := make([]rgb, n)
+	for i := range table {
+		table[i] = colour(i)
+	}
+	return table
+}
+
+// gradient picks the colour t of the way along a palette, t is between 0 and 1.
+func gradient(palette []rgb, t float64) rgb {
+	t = math.Max(0, math.Min(1, t)) * float64(len(palette)-1)
+	i := int(t)
+	if i == len(palette)-1 {
+		return palette[i]
+	}
+	a, b, f := palette[i], palette[i+1], t-float64(i)
+	return rgb{a.r + (b.r-a.r)*f, a.g + (b.g-a.g)*f, a.b + (b.b-a.b)*f}
+}
+
+// SetColourMode changes how cells are coloured, the window title says which mode is on.
+func (w *Window) SetColourMode(mode ColourMode) {
+	w.mode = mode
+	if mode == Plain {
+		w.window.SetTitle("GOL GUI")
+		// Plain keeps no flips, recolour works them out again from changed when it is left
+		w.recent = nil
+	} else {
+		w.window.SetTitle("GOL GUI - " + mode.String())
+		if w.colours == nil {
+			w.colours = make([]byte, len(w.pixels))
+		}
+	}
+	for _, t := range w.tiles {
+		t.dirty = true
+	}
+	w.repaint = true
+	w.stale = true
+}
+
+// NextColourMode moves on to the next colour mode, going back to Plain after the last one.
+func (w *Window) NextColourMode() {
+	w.SetColourMode((w.mode + 1) % colourModes)
+}
+
+// SetTurn tells the window which turn the next flipped cells and frame are for, so cells' ages can be worked out.
+func (w *Window) SetTurn(turn int) {
+	if turn != w.turn {
+		w.turn = turn
+		w.stale = true
+	}
+}
+
+// recordFlip notes that cell i flipped on the current turn, so recolour knows to colour it again. Nothing is kept in
+// Plain, which does not recolour. The heatmap's scale is doubled when the cell has flipped more often than it,
+// which recolours every cell in the heatmap.
+func (w *Window) recordFlip(i int) {
+	if w.mode != Plain {
+		if n := len(w.recent); n == 0 || w.recent[n-1].turn != w.turn {
+			w.recent = append(w.recent, flipped{turn: w.turn})
+		}
+		last := &w.recent[len(w.recent)-1]
+		last.cells = append(last.cells, int32(i))
+	}
+
+	for w.flips[i] > w.heatScale {
+		if w.heatScale > math.MaxUint16/2 {
+			w.heatScale = math.MaxUint16
+		} else {
+			w.heatScale *= 2
+		}
+		w.heatColours = nil
+		w.repaint = w.repaint || w.mode == Heatmap
+	}
+}
+
+// forgetFlips drops the turns whose cells have reached their last colour in every mode.
+func (w *Window) forgetFlips() {
+	old := 0
+	for old < len(w.recent) && w.recent[old].turn < w.turn-oldAge {
+		old++
+	}
+	w.recent = w.recent[old:]
+}
+
+// recolour brings colours up to date for the current mode, marking the tiles it changes to be uploaded. Only cells
+// that flipped recently enough for their colour to have changed since the last recolour are coloured again,
+// unless repaint says every cell has to be.
+func (w *Window) recolour() {
+	if w.heatColours == nil {
+		scale := math.Log1p(float64(w.heatScale))
+		w.heatColours = colourTable(int(w.heatScale)+1, func(flips int) rgb {
+			return gradient(heatPalette, math.Log1p(float64(flips))/scale)
+		})
+	}
+
+	if w.repaint {
+		// recent is built again from the turn each cell last flipped on, the flips are not kept in Plain
+		byAge := make([][]int32, oldAge+1)
+		for i := range w.flips {
+			w.recolourCell(i)
+			if since := w.turn - int(w.changed[i]); w.flips[i] > 0 && since <= oldAge {
+				byAge[since] = append(byAge[since], int32(i))
+			}
+		}
+		w.recent = nil
+		for since := oldAge; since >= 0; since-- {
+			if len(byAge[since]) > 0 {
+				w.recent = append(w.recent, flipped{turn: w.turn - since, cells: byAge[since]})
+			}
+		}
+		for _, t := range w.tiles {
+			t.dirty = true
+		}
+		w.repaint = false
+	} else {
+		// ages and trails go on changing for a while after a cell flips, heat only changes when it flips
+		from := w.recolouredAt
+		switch w.mode {
+		case Age:
+			from -= oldAge
+		case Trails:
+			from -= trailLength
+		}
+		width := int(w.Width)
+		for _, f := range w.recent {
+			if f.turn < from {
+				continue
+			}
+			for _, i := range f.cells {
+				w.recolourCell(int(i))
+				w.tileAt(int(i)%width, int(i)/width).dirty = true
+			}
+		}
+	}
+	w.recolouredAt = w.turn
+	w.forgetFlips()
+}
+
+// recolourCell works out the colour of cell i for the current mode.
+func (w *Window) recolourCell(i int) {
+	alive := w.pixels[4*i] == 0xFF
+	since := w.turn - int(w.changed[i])
+	c := rgb{}
+	switch w.mode {
+	case Age:
+		if alive {
+			c = ageColours[clamp(since, 0, oldAge)]
+		}
+	case Trails:
+		if alive {
+			c = rgb{255, 255, 255}
+		} else if w.flips[i] > 0 && since < trailLength {
+			c = trailColours[clamp(since, 0, trailLength-1)]
+		}
+	case Heatmap:
+		c = w.heatColours[w.flips[i]]
+	}
+	w.colours[4*i+0] = byte(c.b)
+	w.colours[4*i+1] = byte(c.g)
+	w.colours[4*i+2] = byte(c.r)
+	w.colours[4*i+3] = 0xFF
+}
+
+func clamp(n, low, high int) int {
+	if n < low {
+		return low
+	}
+	if n > high {
+		return high
+	}
+	return n
+}
@@ -2,14 +2,55 @@ package sdl
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/veandco/go-sdl2/sdl"
 	"uk.ac.bris.cs/gameoflife/gol"
+	"uk.ac.bris.cs/gameoflife/util"
 )
 
+// zoomStep is how much one notch of the mouse wheel, or one press of + or -, zooms by.
+const zoomStep = 1.25
+
 func Run(p gol.Params, events <-chan gol.Event, keyPresses chan<- rune) {
 	w := NewWindow(int32(p.ImageWidth), int32(p.ImageHeight))
 
+	// While paused, clicking or dragging with the left button flips cells. Each cell is flipped once per drag
+	// however often the mouse crosses it, and fast drags are filled in between the cells the mouse was seen on.
+	// Otherwise dragging pans the view, as dragging with the right or middle button always does.
+	paused := false
+	var dragged map[util.Cell]bool
+	var lastX, lastY int
+	edit := func(x, y int) {
+		steps := abs(x - lastX)
+		if abs(y-lastY) > steps {
+			steps = abs(y - lastY)
+		}
+		if steps == 0 {
+			steps = 1
+		}
+		for i := 0; i <= steps; i++ {
+			cell := util.Cell{X: lastX + (x-lastX)*i/steps, Y: lastY + (y-lastY)*i/steps}
+			if cell.X < 0 || cell.Y < 0 || cell.X >= p.ImageWidth || cell.Y >= p.ImageHeight || dragged[cell] {
+				continue
+			}
+			// The window has to keep draining events while the broker takes the edits, so when they back up
+			// the cell is dropped, and the drag can flip it when it crosses the cell again
+			select {
+			case gol.CellEdits <- cell:
+				dragged[cell] = true
+			default:
+			}
+		}
+		lastX, lastY = x, y
+	}
+	// zoomCentre zooms about the middle of the window, for the keyboard
+	zoomCentre := func(factor float64) {
+		windowWidth, windowHeight := w.window.GetSize()
+		w.ZoomAt(windowWidth/2, windowHeight/2, factor)
+		w.RenderFrame()
+	}
+
 sdlLoop:
 	for {
 		event := w.PollEvent()
@@ -25,6 +66,42 @@ sdlLoop:
 					keyPresses <- 'q'
 				case sdl.K_k:
 					keyPresses <- 'k'
+				case sdl.K_n:
+					keyPresses <- 'n'
+				case sdl.K_0, sdl.K_1, sdl.K_2, sdl.K_3, sdl.K_4, sdl.K_5, sdl.K_6, sdl.K_7, sdl.K_8, sdl.K_9:
+					keyPresses <- rune('0' + e.Keysym.Sym - sdl.K_0)
+				case sdl.K_c:
+					w.NextColourMode()
+					w.RenderFrame()
+				case sdl.K_f, sdl.K_HOME:
+					w.Fit()
+					w.RenderFrame()
+				case sdl.K_EQUALS, sdl.K_KP_PLUS:
+					zoomCentre(zoomStep)
+				case sdl.K_MINUS, sdl.K_KP_MINUS:
+					zoomCentre(1 / zoomStep)
+				}
+			case *sdl.MouseButtonEvent:
+				if paused && e.Button == sdl.BUTTON_LEFT && e.State == sdl.PRESSED {
+					dragged = make(map[util.Cell]bool)
+					lastX, lastY = w.CellAt(e.X, e.Y)
+					edit(lastX, lastY)
+				}
+			case *sdl.MouseMotionEvent:
+				if paused && dragged != nil && e.State&sdl.ButtonLMask() != 0 {
+					edit(w.CellAt(e.X, e.Y))
+				} else {
+					w.Pan(e.XRel, e.YRel)
+					w.RenderFrame()
+				}
+			case *sdl.MouseWheelEvent:
+				x, y, _ := sdl.GetMouseState()
+				w.ZoomAt(x, y, math.Pow(zoomStep, float64(e.Y)))
+				w.RenderFrame()
+			case *sdl.WindowEvent:
+				if e.Event == sdl.WINDOWEVENT_SIZE_CHANGED {
+					w.Resized()
+					w.RenderFrame()
 				}
 			}
 		}
@@ -36,12 +113,18 @@ sdlLoop:
 			}
 			switch e := event.(type) {
 			case gol.CellFlipped:
+				w.SetTurn(e.CompletedTurns)
 				w.FlipPixel(e.Cell.X, e.Cell.Y)
 			case gol.TurnComplete:
+				w.SetTurn(e.CompletedTurns)
 				w.RenderFrame()
 			case gol.FinalTurnComplete:
 				w.Destroy()
 				break sdlLoop
+			case gol.StateChange:
+				paused = e.NewState == gol.Paused
+				dragged = nil
+				fmt.Printf("Completed Turns %-8v%v\n", event.GetCompletedTurns(), event)
 			default:
 				if len(event.String()) > 0 {
 					fmt.Printf("Completed Turns %-8v%v\n", event.GetCompletedTurns(), event)
@@ -53,3 +136,10 @@ sdlLoop:
 	}
 
 }
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -2,77 +2,263 @@ package sdl
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/veandco/go-sdl2/sdl"
 	"uk.ac.bris.cs/gameoflife/util"
 )
 
+// tileSize is the side of each texture the board is split into, GPUs cap how big one texture can be.
+const tileSize = 2048
+
+// maxWindowSize is the most the window opens at on either side, bigger boards start zoomed out to fit.
+const maxWindowSize = 1024
+
+// minimapSize is the longest side of the minimap shown while the view covers only part of the board.
+const minimapSize = 160
+
+// maxZoom is the most window pixels a cell can be zoomed in to.
+const maxZoom = 64
+
+// tile is one texture's worth of the board, only tiles with flipped pixels are uploaded again.
+type tile struct {
+	texture *sdl.Texture
+	cells   sdl.Rect // the part of the board the tile shows
+	dirty   bool
+}
+
+// Window shows the board through a viewport: zoom is how many window pixels a cell takes, and the cell
+// at the top left corner of the window is (offsetX, offsetY). While fit is set the whole board is shown.
+// pixels holds the board in white and black, colours holds it as the colour mode draws it. changed is the
+// turn each cell last flipped on and flips how many times it has, stale is set when colours is out of date.
+// recent holds the cells flipped on each turn whose colours may still change, so only they are recoloured
+// unless repaint is set, and is empty in Plain. The heatmap is scaled to heatScale flips, and heatColours has
+// the colour of each count.
 type Window struct {
-	Width, Height int32
-	window        *sdl.Window
-	renderer      *sdl.Renderer
-	texture       *sdl.Texture
-	pixels        []byte
+	Width, Height    int32
+	window           *sdl.Window
+	renderer         *sdl.Renderer
+	tiles            []*tile
+	pixels           []byte
+	zoom             float64
+	offsetX, offsetY float64
+	fit              bool
+	mode             ColourMode
+	colours          []byte
+	turn             int
+	changed          []int32
+	flips            []uint16
+	stale            bool
+	recent           []flipped
+	recolouredAt     int
+	repaint          bool
+	heatScale        uint16
+	heatColours      []rgb
 }
 
 func filterEvent(e sdl.Event, userdata interface{}) bool {
-	return e.GetType() == sdl.KEYDOWN || e.GetType() == sdl.QUIT
+	if motion, ok := e.(*sdl.MouseMotionEvent); ok {
+		// only drags are wanted, there would be a flood of events otherwise
+		return motion.State&(sdl.ButtonLMask()|sdl.ButtonMMask()|sdl.ButtonRMask()) != 0
+	}
+	switch e.GetType() {
+	case sdl.KEYDOWN, sdl.QUIT, sdl.MOUSEBUTTONDOWN, sdl.MOUSEWHEEL, sdl.WINDOWEVENT:
+		return true
+	}
+	return false
 }
 
 func NewWindow(width, height int32) *Window {
 	err := sdl.Init(sdl.INIT_EVERYTHING)
 	util.Check(err)
-	window, err := sdl.CreateWindow("GOL GUI", sdl.WINDOWPOS_CENTERED, sdl.WINDOWPOS_CENTERED, width, height, sdl.WINDOW_SHOWN)
+	scale := math.Min(1, math.Min(float64(maxWindowSize)/float64(width), float64(maxWindowSize)/float64(height)))
+	windowWidth := int32(math.Max(1, float64(width)*scale))
+	windowHeight := int32(math.Max(1, float64(height)*scale))
+	window, err := sdl.CreateWindow("GOL GUI", sdl.WINDOWPOS_CENTERED, sdl.WINDOWPOS_CENTERED, windowWidth, windowHeight, sdl.WINDOW_SHOWN|sdl.WINDOW_RESIZABLE)
 	util.Check(err)
 	renderer, err := sdl.CreateRenderer(window, -1, sdl.WINDOW_SHOWN)
 	util.Check(err)
-	sdl.SetHint(sdl.HINT_RENDER_SCALE_QUALITY, "linear")
-	err = renderer.SetLogicalSize(width, height)
-	util.Check(err)
-	texture, err := renderer.CreateTexture(sdl.PIXELFORMAT_ARGB8888, sdl.TEXTUREACCESS_STATIC, width, height)
-	util.Check(err)
+	// cells stay sharp squares when zoomed in
+	sdl.SetHint(sdl.HINT_RENDER_SCALE_QUALITY, "nearest")
+
+	var tiles []*tile
+	for y := int32(0); y < height; y += tileSize {
+		for x := int32(0); x < width; x += tileSize {
+			cells := sdl.Rect{X: x, Y: y, W: min(tileSize, width-x), H: min(tileSize, height-y)}
+			texture, err := renderer.CreateTexture(sdl.PIXELFORMAT_ARGB8888, sdl.TEXTUREACCESS_STATIC, cells.W, cells.H)
+			util.Check(err)
+			tiles = append(tiles, &tile{texture, cells, true})
+		}
+	}
 
 	sdl.SetEventFilterFunc(filterEvent, nil)
-	return &Window{
-		width,
-		height,
-		window,
-		renderer,
-		texture,
-		make([]byte, width*height*4),
+	w := &Window{
+		Width:    width,
+		Height:   height,
+		window:   window,
+		renderer: renderer,
+		tiles:    tiles,
+		pixels:   make([]byte, width*height*4),
+		changed:  make([]int32, width*height),
+		flips:    make([]uint16, width*height),
 	}
+	w.heatScale = 1
+	w.Fit()
+	return w
 }
 
 func (w *Window) Destroy() {
-	err := w.texture.Destroy()
-	util.Check(err)
-	err = w.renderer.Destroy()
+	for _, t := range w.tiles {
+		err := t.texture.Destroy()
+		util.Check(err)
+	}
+	err := w.renderer.Destroy()
 	util.Check(err)
 	err = w.window.Destroy()
 	util.Check(err)
 	sdl.Quit()
 }
 
+// screenRect is where part of the board ends up in the window, given how many window pixels a cell takes
+// and the cell at the window's top left. Edges are rounded the same way so neighbouring tiles meet exactly.
+func screenRect(cells sdl.Rect, zoom, offsetX, offsetY float64, originX, originY int32) sdl.Rect {
+	x0 := int32(math.Round((float64(cells.X) - offsetX) * zoom))
+	y0 := int32(math.Round((float64(cells.Y) - offsetY) * zoom))
+	x1 := int32(math.Round((float64(cells.X+cells.W) - offsetX) * zoom))
+	y1 := int32(math.Round((float64(cells.Y+cells.H) - offsetY) * zoom))
+	return sdl.Rect{X: originX + x0, Y: originY + y0, W: x1 - x0, H: y1 - y0}
+}
+
 func (w *Window) RenderFrame() {
-	err := w.texture.Update(nil, w.pixels, int(w.Width*4))
+	pixels := w.pixels
+	if w.mode != Plain {
+		if w.stale {
+			w.recolour()
+			w.stale = false
+		}
+		pixels = w.colours
+	}
+	for _, t := range w.tiles {
+		if t.dirty {
+			start := 4 * (t.cells.Y*w.Width + t.cells.X)
+			err := t.texture.Update(nil, pixels[start:], int(w.Width*4))
+			util.Check(err)
+			t.dirty = false
+		}
+	}
+
+	err := w.renderer.SetDrawColor(0, 0, 0, 0xFF)
 	util.Check(err)
 	err = w.renderer.Clear()
 	util.Check(err)
-	err = w.renderer.Copy(w.texture, nil, nil)
-	util.Check(err)
+	windowWidth, windowHeight := w.window.GetSize()
+	window := sdl.Rect{W: windowWidth, H: windowHeight}
+	for _, t := range w.tiles {
+		dst := screenRect(t.cells, w.zoom, w.offsetX, w.offsetY, 0, 0)
+		if dst.HasIntersection(&window) {
+			err = w.renderer.Copy(t.texture, nil, &dst)
+			util.Check(err)
+		}
+	}
+
+	// The minimap shows the whole board in a corner, with a box round the part in view
+	viewWidth, viewHeight := float64(windowWidth)/w.zoom, float64(windowHeight)/w.zoom
+	if w.offsetX > 0.5 || w.offsetY > 0.5 || w.offsetX+viewWidth < float64(w.Width)-0.5 || w.offsetY+viewHeight < float64(w.Height)-0.5 {
+		view := sdl.Rect{X: int32(w.offsetX), Y: int32(w.offsetY), W: int32(viewWidth), H: int32(viewHeight)}
+		scale := float64(minimapSize) / float64(max(w.Width, w.Height))
+		mapWidth, mapHeight := int32(float64(w.Width)*scale), int32(float64(w.Height)*scale)
+		originX, originY := windowWidth-mapWidth-8, int32(8)
+		frame := sdl.Rect{X: originX - 1, Y: originY - 1, W: mapWidth + 2, H: mapHeight + 2}
+		err = w.renderer.SetDrawColor(0x40, 0x40, 0x40, 0xFF)
+		util.Check(err)
+		err = w.renderer.FillRect(&frame)
+		util.Check(err)
+		for _, t := range w.tiles {
+			dst := screenRect(t.cells, scale, 0, 0, originX, originY)
+			err = w.renderer.Copy(t.texture, nil, &dst)
+			util.Check(err)
+		}
+		box := screenRect(view, scale, 0, 0, originX, originY)
+		mapRect := sdl.Rect{X: originX, Y: originY, W: mapWidth, H: mapHeight}
+		box, _ = box.Intersect(&mapRect)
+		err = w.renderer.SetDrawColor(0xFF, 0x30, 0x30, 0xFF)
+		util.Check(err)
+		err = w.renderer.DrawRect(&box)
+		util.Check(err)
+	}
 	w.renderer.Present()
 }
 
+// Fit zooms so the whole board is in the window and centres it, and keeps it that way as the window is resized.
+func (w *Window) Fit() {
+	windowWidth, windowHeight := w.window.GetSize()
+	w.zoom = math.Min(float64(windowWidth)/float64(w.Width), float64(windowHeight)/float64(w.Height))
+	w.offsetX = (float64(w.Width) - float64(windowWidth)/w.zoom) / 2
+	w.offsetY = (float64(w.Height) - float64(windowHeight)/w.zoom) / 2
+	w.fit = true
+}
+
+// Resized keeps the board fitted to the window if it was.
+func (w *Window) Resized() {
+	if w.fit {
+		w.Fit()
+	}
+}
+
+// ZoomAt zooms in or out by factor, keeping the cell under window pixel (x, y) where it is.
+// It zooms out no further than it takes to fit the board in the window.
+func (w *Window) ZoomAt(x, y int32, factor float64) {
+	windowWidth, windowHeight := w.window.GetSize()
+	minZoom := math.Min(1, math.Min(float64(windowWidth)/float64(w.Width), float64(windowHeight)/float64(w.Height)))
+	zoom := math.Max(minZoom, math.Min(maxZoom, w.zoom*factor))
+	cellX, cellY := w.offsetX+float64(x)/w.zoom, w.offsetY+float64(y)/w.zoom
+	w.zoom = zoom
+	w.offsetX, w.offsetY = cellX-float64(x)/zoom, cellY-float64(y)/zoom
+	w.fit = false
+}
+
+// Pan moves the view by a number of window pixels.
+func (w *Window) Pan(dx, dy int32) {
+	w.offsetX -= float64(dx) / w.zoom
+	w.offsetY -= float64(dy) / w.zoom
+	w.fit = false
+}
+
+// CellAt returns the cell under window pixel (x, y).
+func (w *Window) CellAt(x, y int32) (int, int) {
+	return int(math.Floor(w.offsetX + float64(x)/w.zoom)), int(math.Floor(w.offsetY + float64(y)/w.zoom))
+}
+
 func (w *Window) PollEvent() sdl.Event {
 	return sdl.PollEvent()
 }
 
+// markDirty flags the tile holding pixel (x, y) to be uploaded on the next frame, and records that the cell
+// flipped on the current turn.
+func (w *Window) markDirty(x, y int) {
+	w.tileAt(x, y).dirty = true
+	i := y*int(w.Width) + x
+	w.changed[i] = int32(w.turn)
+	if w.flips[i] < math.MaxUint16 {
+		w.flips[i]++
+	}
+	w.recordFlip(i)
+	w.stale = true
+}
+
+// tileAt returns the tile holding pixel (x, y).
+func (w *Window) tileAt(x, y int) *tile {
+	tilesAcross := (int(w.Width) + tileSize - 1) / tileSize
+	return w.tiles[y/tileSize*tilesAcross+x/tileSize]
+}
+
 func (w *Window) SetPixel(x, y int) {
 	width := int(w.Width)
 	w.pixels[4*(y*width+x)+0] = 0xFF
 	w.pixels[4*(y*width+x)+1] = 0xFF
 	w.pixels[4*(y*width+x)+2] = 0xFF
 	w.pixels[4*(y*width+x)+3] = 0xFF
+	w.markDirty(x, y)
 }
 
 func (w *Window) FlipPixel(x, y int) {
@@ -85,6 +271,7 @@ func (w *Window) FlipPixel(x, y int) {
 	w.pixels[4*(y*width+x)+1] = ^w.pixels[4*(y*width+x)+1]
 	w.pixels[4*(y*width+x)+2] = ^w.pixels[4*(y*width+x)+2]
 	w.pixels[4*(y*width+x)+3] = ^w.pixels[4*(y*width+x)+3]
+	w.markDirty(x, y)
 }
 
 func (w *Window) CountPixels() int {
@@ -101,4 +288,29 @@ func (w *Window) ClearPixels() {
 	for i := range w.pixels {
 		w.pixels[i] = 0
 	}
+	for i := range w.flips {
+		w.changed[i] = 0
+		w.flips[i] = 0
+	}
+	w.recent = nil
+	w.heatScale, w.heatColours = 1, nil
+	w.repaint = true
+	w.stale = true
+	for _, t := range w.tiles {
+		t.dirty = true
+	}
+}
+
+func min(a, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"uk.ac.bris.cs/gameoflife/stubs"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+var checkpointInterval int
+var checkpointDir string
+
+// checkpointsKept is how many of the newest checkpoints are left on disk
+const checkpointsKept = 2
+
+// checkpoint is everything needed to carry on a game after the broker or client crashes
+type checkpoint struct {
+	Turn        int
+	Turns       int
+	Threads     int
+	ImageWidth  int
+	ImageHeight int
+	Rule        string
+	Boundary    string
+	World       util.BitBoard
+}
+
+// Each game saves its checkpoints in a directory of its own in checkpointDir
+func gameDir(id int) string {
+	return filepath.Join(checkpointDir, fmt.Sprintf("game_%d", id))
+}
+
+func checkpointPath(dir string, turn int) string {
+	return filepath.Join(dir, fmt.Sprintf("checkpoint_%010d.gob", turn))
+}
+
+// Returns the checkpoint files in a game's directory, oldest first
+func checkpointFiles(dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "checkpoint_*.gob"))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Saves the game's world at a turn, writing to a temporary file first so a crash never leaves half a checkpoint.
+// A resumed game's first checkpoint replaces the ones it was resumed from.
+func (g *game) saveCheckpoint(req stubs.Request, turn int, world util.BitBoard) error {
+	dir := gameDir(g.id)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, "checkpoint_*.tmp")
+	if err != nil {
+		return err
+	}
+	cp := checkpoint{Turn: turn, Turns: req.Turns, Threads: req.Threads, ImageWidth: req.ImageWidth, ImageHeight: req.ImageHeight, Rule: req.Rule, Boundary: req.Boundary, World: world}
+	err = gob.NewEncoder(file).Encode(cp)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	err = os.Rename(file.Name(), checkpointPath(dir, turn))
+	if err != nil {
+		return err
+	}
+
+	files := checkpointFiles(dir)
+	for i := 0; i < len(files)-checkpointsKept; i++ {
+		os.Remove(files[i])
+	}
+	if g.resumedFrom != "" {
+		os.RemoveAll(g.resumedFrom)
+		g.resumedFrom = ""
+	}
+	fmt.Printf("Saved checkpoint of game %d at turn %d\n", g.id, turn)
+	return nil
+}
+
+// Checkpoints the game if every slice has a snapshot for this turn and enough turns have passed since the last one
+func (g *game) checkpointIfDue(req stubs.Request, turn int) {
+	if checkpointInterval <= 0 || turn-g.lastCheckpoint < checkpointInterval {
+		return
+	}
+	for _, ws := range g.workerSlices {
+		if ws.snapshotTurn != turn {
+			return
+		}
+	}
+	err := g.saveCheckpoint(req, turn, g.assembleWorld())
+	if err != nil {
+		fmt.Println("Could not save checkpoint:", err)
+		return
+	}
+	g.lastCheckpoint = turn
+}
+
+func readCheckpoint(path string) (checkpoint, error) {
+	var cp checkpoint
+	file, err := os.Open(path)
+	if err != nil {
+		return cp, err
+	}
+	defer file.Close()
+	err = gob.NewDecoder(file).Decode(&cp)
+	return cp, err
+}
+
+// Loads the newest checkpoint of a world the size given, returning the directory it is in. Games being hosted
+// are passed over, they are still running so are not there to resume.
+func loadCheckpoint(width, height int) (checkpoint, string, error) {
+	dirs, _ := filepath.Glob(filepath.Join(checkpointDir, "game_*"))
+	gamesMutex.Lock()
+	hosted := make(map[string]bool)
+	for id := range games {
+		hosted[gameDir(id)] = true
+	}
+	gamesMutex.Unlock()
+
+	var newest checkpoint
+	var newestDir string
+	var newestTime time.Time
+	for _, dir := range dirs {
+		files := checkpointFiles(dir)
+		if hosted[dir] || len(files) == 0 {
+			continue
+		}
+		path := files[len(files)-1]
+		info, err := os.Stat(path)
+		if err != nil || (newestDir != "" && !info.ModTime().After(newestTime)) {
+			continue
+		}
+		cp, err := readCheckpoint(path)
+		if err != nil || cp.ImageWidth != width || cp.ImageHeight != height {
+			continue
+		}
+		newest, newestDir, newestTime = cp, dir, info.ModTime()
+	}
+	if newestDir == "" {
+		return newest, "", fmt.Errorf("no checkpoint of a %dx%d world found in %s", width, height, checkpointDir)
+	}
+	return newest, newestDir, nil
+}
+
+// Returns the highest game id with a checkpoint directory, new games are numbered after it
+func lastCheckpointedGame() int {
+	dirs, _ := filepath.Glob(filepath.Join(checkpointDir, "game_*"))
+	last := 0
+	for _, dir := range dirs {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "game_"))
+		if err == nil && id > last {
+			last = id
+		}
+	}
+	return last
+}
+
+// Removes the game's checkpoints once it has finished, along with any it was resumed from
+func (g *game) clearCheckpoints() {
+	os.RemoveAll(gameDir(g.id))
+	if g.resumedFrom != "" {
+		os.RemoveAll(g.resumedFrom)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"uk.ac.bris.cs/gameoflife/stubs"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// game is one of the games the broker is hosting. Every game has its own slices, controller, observers and
+// streams, all guarded by its mutex, and they share the registered nodes between them.
+type game struct {
+	id             int
+	mutex          sync.Mutex
+	turn           int
+	world          util.BitBoard
+	alive          int
+	nodes          []*node
+	workerSlices   []*workerSlice
+	slicesRunning  sync.WaitGroup
+	paused         bool
+	pauseTurn      int // while paused, the turn the nodes stop after
+	rebalanceTurn  int // while moving rows between slices, the turn the nodes are held on for it
+	rebalanceRows  [][]int
+	rebalanceNodes []string // the nodes to move the game onto at rebalanceTurn, nil to keep it where it is
+	imbalanced     int      // rebalance intervals in a row the slices have been out of balance
+	stopHeartbeats chan bool
+	running        bool
+	request        stubs.Request
+	done           chan bool
+	stop           chan bool
+	attached       *controller
+	lost           int  // the controller whose stream broke without it detaching, 0 once another attaches
+	abandoned      bool // stopped because its controller went away and did not come back
+	observers      map[int]*controller
+	subscribers    []*subscriber
+	lastCheckpoint int
+	resumedFrom    string // checkpoints of the game this one was resumed from, removed once it has its own
+}
+
+var games = make(map[int]*game)
+var nextGameID int
+
+// gamesMutex guards games and nextGameID. It is taken before a game's mutex, never while holding one.
+var gamesMutex sync.Mutex
+
+// idMutex guards the slice and controller ids, which are handed out while holding a game's mutex
+var idMutex sync.Mutex
+var nextSliceID int
+var nextControllerID int
+
+// Adds a game waiting for its controller to start it, gamesMutex must be held
+func newGame() *game {
+	nextGameID++
+	g := &game{id: nextGameID, observers: make(map[int]*controller)}
+	games[g.id] = g
+	return g
+}
+
+func findGame(id int) (*game, error) {
+	gamesMutex.Lock()
+	defer gamesMutex.Unlock()
+	g, ok := games[id]
+	if !ok {
+		return nil, fmt.Errorf("there is no game %d on the broker", id)
+	}
+	return g, nil
+}
+
+// Forgets a game once it has finished, or once its controller leaves before starting it
+func removeGame(g *game) {
+	gamesMutex.Lock()
+	defer gamesMutex.Unlock()
+	if games[g.id] == g {
+		delete(games, g.id)
+	}
+}
+
+// Picks the game an attaching client without a game id joins. An observer watches the newest running game of
+// its size. A controller always gets a new game of its own, a game that has lost its controller may belong to
+// someone else, so taking it back needs its id.
+func pickGame(req stubs.AttachRequest) (*game, error) {
+	gamesMutex.Lock()
+	defer gamesMutex.Unlock()
+	if !req.Observer {
+		return newGame(), nil
+	}
+	var ids []int
+	for id := range games {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	for _, id := range ids {
+		g := games[id]
+		g.mutex.Lock()
+		fits := g.running && g.request.ImageWidth == req.ImageWidth && g.request.ImageHeight == req.ImageHeight
+		g.mutex.Unlock()
+		if fits {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("no %dx%d game is running to observe", req.ImageWidth, req.ImageHeight)
+}
+
+func newSliceID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	nextSliceID++
+	return nextSliceID
+}
+
+func newControllerID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	nextControllerID++
+	return nextControllerID
+}
+
+// Counts the live slices on every node across all the games, and how many games are running
+func nodeLoad() (map[string]int, int) {
+	gamesMutex.Lock()
+	defer gamesMutex.Unlock()
+	load := make(map[string]int)
+	running := 0
+	for _, g := range games {
+		g.mutex.Lock()
+		if g.running {
+			running++
+		}
+		for _, ws := range g.workerSlices {
+			if !ws.node.dead {
+				load[ws.node.address]++
+			}
+		}
+		g.mutex.Unlock()
+	}
+	return load, running
+}
+
+// Picks the registered nodes a game starting now runs on. The nodes are shared evenly between the running games,
+// least loaded first, so a game started while others are running gets its share without piling onto their nodes.
+// The games already running move onto their new share at their next rebalance, as does every game once one finishes.
+func scheduleWorkers() []string {
+	workersMutex.Lock()
+	registered := append([]string(nil), workers...)
+	workersMutex.Unlock()
+
+	load, running := nodeLoad()
+	return shareNodes(registered, load, nil, nodeShare(len(registered), running))
+}
+
+// How many of the registered nodes each running game gets
+func nodeShare(registered, running int) int {
+	if running < 1 {
+		running = 1
+	}
+	return (registered + running - 1) / running
+}
+
+// Picks the share of the registered nodes least loaded by other games. On a tie the nodes in own come first, so a
+// game that already has its share keeps it rather than swapping nodes with another.
+func shareNodes(registered []string, load map[string]int, own []string, share int) []string {
+	owned := make(map[string]bool)
+	for _, address := range own {
+		owned[address] = true
+	}
+	nodes := append([]string(nil), registered...)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if load[nodes[i]] != load[nodes[j]] {
+			return load[nodes[i]] < load[nodes[j]]
+		}
+		return owned[nodes[i]] && !owned[nodes[j]]
+	})
+	if share > len(nodes) {
+		share = len(nodes)
+	}
+	return nodes[:share]
+}
+
+// Checks the caller is the game's attached controller, observers cannot change the game. g.mutex must be held.
+func (g *game) checkController(id int) error {
+	if g.attached == nil || g.attached.id != id {
+		if _, ok := g.observers[id]; ok {
+			return errors.New("only the controller can do that, this client is observing")
+		}
+		return errors.New("not attached to this game")
+	}
+	return nil
+}
+
+func (g *game) isStopping() bool {
+	select {
+	case <-g.stop:
+		return true
+	default:
+		return false
+	}
+}
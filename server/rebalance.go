@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"uk.ac.bris.cs/gameoflife/stubs"
+)
+
+var rebalanceInterval int
+
+// rebalanceThreshold is how many times longer the slowest slice's turns can take than the fastest's before rows
+// are moved between them. Nodes sharing a host are timed against each other, so it is well clear of the noise.
+const rebalanceThreshold = 1.5
+
+// rebalancePersistence is how many rebalance intervals in a row the slices have to be out of balance before rows
+// are moved, so a node that was slow for a moment keeps its rows
+const rebalancePersistence = 3
+
+// minRebalanceTurn is the turn time below which slices are not rebalanced, their timings are mostly noise
+const minRebalanceTurn = 200 * time.Microsecond
+
+// minRebalanceRows is the fewest rows worth moving across a boundary, fewer is left where it is
+const minRebalanceRows = 4
+
+// Folds the time each slice's node spent on its turns since the last rebalance into its time per row. That is
+// averaged with the earlier intervals, so one slow interval does not move rows on its own.
+func smoothRowTimes(slices []*workerSlice) {
+	for _, ws := range slices {
+		if ws.busyTurns > 0 && ws.busy > 0 {
+			rowTime := ws.busy.Seconds() / float64(ws.busyTurns) / float64(ws.endY-ws.startY)
+			if ws.rowTime > 0 {
+				rowTime = (ws.rowTime + rowTime) / 2
+			}
+			ws.rowTime = rowTime
+		}
+		ws.busy, ws.busyTurns = 0, 0
+	}
+}
+
+// Works out new rows for the slices, top to bottom, from how long their nodes take over a row. Each slice moves
+// halfway towards the rows that would make every turn take as long, and boundaries that would move fewer than
+// minRebalanceRows stay put, so noise in the timings does not throw rows back and forth. Returns false when the
+// turns already take about as long.
+func balancedBounds(slices []*workerSlice, height int) ([][]int, bool) {
+	if len(slices) < 2 {
+		return nil, false
+	}
+	speeds := make([]float64, len(slices))
+	total := 0.0
+	slowest, fastest := 0.0, 0.0
+	for i, ws := range slices {
+		if ws.rowTime <= 0 {
+			return nil, false
+		}
+		turnTime := ws.rowTime * float64(ws.endY-ws.startY)
+		if turnTime > slowest {
+			slowest = turnTime
+		}
+		if fastest == 0 || turnTime < fastest {
+			fastest = turnTime
+		}
+		speeds[i] = 1 / ws.rowTime
+		total += speeds[i]
+	}
+	if slowest < minRebalanceTurn.Seconds() || slowest < rebalanceThreshold*fastest {
+		return nil, false
+	}
+
+	var bounds [][]int
+	changed := false
+	start := 0
+	end := 0.0
+	for i, ws := range slices {
+		rows := float64(ws.endY - ws.startY)
+		end += rows + (float64(height)*speeds[i]/total-rows)/2
+		endY := int(math.Round(end))
+		if endY-ws.endY < minRebalanceRows && ws.endY-endY < minRebalanceRows {
+			endY = ws.endY
+		}
+		// every slice keeps at least a row
+		if endY > height-(len(slices)-1-i) {
+			endY = height - (len(slices) - 1 - i)
+		}
+		if endY <= start {
+			endY = start + 1
+		}
+		if i == len(slices)-1 {
+			endY = height
+		}
+		bounds = append(bounds, []int{start, endY})
+		changed = changed || endY != ws.endY
+		start = endY
+	}
+	return bounds, changed
+}
+
+// Counts the rebalance intervals in a row the slices have been out of balance. Returns true once there have been
+// rebalancePersistence of them, and starts counting again.
+func (g *game) imbalancePersists(imbalanced bool) bool {
+	if !imbalanced {
+		g.imbalanced = 0
+		return false
+	}
+	g.imbalanced++
+	if g.imbalanced < rebalancePersistence {
+		return false
+	}
+	g.imbalanced = 0
+	return true
+}
+
+// Moves rows between neighbouring slices so every node takes about as long over a turn, and moves the game onto
+// its share of the registered nodes when games have started or finished since it did. Every rebalanceInterval
+// turns it works out the new rows and nodes, and once the rows have been out of balance for long enough, or the
+// nodes have changed, it holds the nodes at the furthest turn any of them has started, like a pause, as nodes run
+// ahead of the broker. Once the broker has the reports up to that turn moveRows moves the rows.
+func (g *game) rebalance(req stubs.Request, turn int) {
+	var registered []string
+	var load map[string]int
+	running := 0
+	if turn%rebalanceInterval == 0 {
+		workersMutex.Lock()
+		registered = append([]string(nil), workers...)
+		workersMutex.Unlock()
+		load, running = nodeLoad()
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.rebalanceTurn > 0 {
+		if turn == g.rebalanceTurn {
+			g.moveRows(req, turn)
+		}
+		return
+	}
+	if turn%rebalanceInterval != 0 {
+		return
+	}
+	smoothRowTimes(g.workerSlices)
+	bounds, ok := balancedBounds(g.workerSlices, req.ImageHeight)
+	dead := false
+	var own []string
+	for _, ws := range g.workerSlices {
+		dead = dead || ws.node.dead
+		own = append(own, ws.node.address)
+		load[ws.node.address]--
+	}
+	share := nodeShare(len(registered), running)
+	if share > req.ImageHeight {
+		share = req.ImageHeight
+	}
+	nodes := shareNodes(registered, load, own, share)
+	if len(nodes) == 0 || sameNodes(nodes, own) {
+		nodes = nil
+	}
+	ok = g.imbalancePersists(ok && !dead)
+	if dead || !ok && nodes == nil || g.paused || g.isStopping() {
+		return
+	}
+
+	furthest, err := g.pauseNodes(stubs.PauseRequest{Command: "PAUSE"})
+	if furthest < turn {
+		furthest = turn
+	}
+	if err == nil && furthest < req.Turns {
+		_, err = g.pauseNodes(stubs.PauseRequest{Command: "RUNTO", Turn: furthest})
+	}
+	if err != nil || furthest >= req.Turns {
+		// a node could not be held, or the game finishes before the rows could be moved
+		g.pauseNodes(stubs.PauseRequest{Command: "RESUME"})
+		return
+	}
+	g.rebalanceTurn = furthest
+	g.rebalanceRows = bounds
+	g.rebalanceNodes = nodes
+	if furthest == turn {
+		g.moveRows(req, turn)
+	}
+}
+
+// Moves the slices' edges to the rows rebalance worked out, with every slice held on turn and the broker's world
+// complete up to it. A slice is only sent the rows it takes from its neighbours and drops the ones it gives them,
+// and its snapshot is moved on to its new rows. g.mutex must be held.
+func (g *game) moveRows(req stubs.Request, turn int) {
+	bounds, nodes := g.rebalanceRows, g.rebalanceNodes
+	g.rebalanceTurn, g.rebalanceRows, g.rebalanceNodes = 0, nil, nil
+	if nodes != nil {
+		g.moveNodes(req, turn, nodes)
+		g.pauseNodes(stubs.PauseRequest{Command: "RESUME"})
+		return
+	}
+	var moved []string
+	var failed []*workerSlice
+	for i, ws := range g.workerSlices {
+		startY, endY := bounds[i][0], bounds[i][1]
+		if startY == ws.startY && endY == ws.endY {
+			continue
+		}
+		resize := stubs.ResizeRequest{Slice: ws.id, Turn: turn, StartY: startY, EndY: endY}
+		keepFrom, keepTo := resize.Kept(ws.startY, ws.endY)
+		if keepFrom > startY {
+			resize.Top = g.world.Rows(startY, keepFrom)
+		}
+		if endY > keepTo {
+			resize.Bottom = g.world.Rows(keepTo, endY)
+		}
+		ws.startY, ws.endY = startY, endY
+		ws.snapshot = g.world.Rows(startY, endY).Copy()
+		ws.snapshotTurn = turn
+		err := ws.node.client.Call(stubs.ResizeSlice, resize, &stubs.EmptyResponse{})
+		if err != nil {
+			fmt.Printf("Could not move rows on worker node %s: %s\n", ws.node.address, err)
+			failed = append(failed, ws)
+		}
+		moved = append(moved, fmt.Sprintf("%s %d-%d", ws.node.address, startY, endY))
+	}
+
+	// A slice that could not be moved is stopped and started again on the same node from its new snapshot. Its node
+	// may well be alive, if it is not the restart fails and the slice is moved off it like any other. The slice
+	// cannot send its neighbours its new edge rows, so the broker does, and neighbours that are being started
+	// again as well take each other's edge rows from their snapshots.
+	restarted := make(map[*workerSlice]bool)
+	for _, ws := range failed {
+		ws.node.client.Call(stubs.StopSlice, stubs.SliceRequest{Slice: ws.id}, &stubs.EmptyResponse{})
+		ws.id = newSliceID()
+		ws.busy, ws.busyTurns = 0, 0
+		restarted[ws] = true
+	}
+	for _, ws := range failed {
+		request := g.nodeRequest(ws, req)
+		up, down := g.neighbours(ws)
+		if restarted[up] {
+			request.FromAbove = [][]uint64{up.snapshot.Row(up.snapshot.Height - 1)}
+		} else {
+			up.node.client.Call(stubs.SendHaloToNode, stubs.HaloRequest{Slice: up.id, Turn: turn, FromAbove: false, Halo: ws.snapshot.Row(0)}, &stubs.EmptyResponse{})
+			request.FromAbove = redirect(up, ws, true)
+		}
+		if restarted[down] {
+			request.FromBelow = [][]uint64{down.snapshot.Row(0)}
+		} else {
+			down.node.client.Call(stubs.SendHaloToNode, stubs.HaloRequest{Slice: down.id, Turn: turn, FromAbove: true, Halo: ws.snapshot.Row(ws.snapshot.Height - 1)}, &stubs.EmptyResponse{})
+			request.FromBelow = redirect(down, ws, false)
+		}
+		g.slicesRunning.Add(1)
+		go g.workerNode(ws.node.client, request)
+	}
+	fmt.Printf("Rebalancing game %d at turn %d: %s\n", g.id, turn, strings.Join(moved, ", "))
+	g.pauseNodes(stubs.PauseRequest{Command: "RESUME"})
+}
+
+// Moves the game onto the nodes rebalance picked for it, with every slice held on turn and the broker's world
+// complete up to it. Its slices are stopped and the rows split evenly between new ones on the nodes, as when the
+// game started. Nodes the game no longer has slices on are kept in g.nodes, like dead ones. g.mutex must be held.
+func (g *game) moveNodes(req stubs.Request, turn int, addresses []string) {
+	var nodes []*node
+	for _, address := range addresses {
+		if n := g.gameNode(address); n != nil {
+			nodes = append(nodes, n)
+		}
+	}
+	if len(nodes) == 0 {
+		return
+	}
+	for _, ws := range g.workerSlices {
+		ws.node.client.Call(stubs.StopSlice, stubs.SliceRequest{Slice: ws.id}, &stubs.EmptyResponse{})
+	}
+	world := g.world.Copy()
+	g.splitRows(nodes, req.ImageHeight, world, turn)
+	g.startSlices(req, world, turn)
+	g.imbalanced = 0
+	fmt.Printf("Moving game %d onto %d worker nodes at turn %d: %s\n", g.id, len(nodes), turn, strings.Join(addresses, ", "))
+}
+
+// Returns the game's live node at an address, dialling it first if the game has not used it yet. Returns nil if it
+// cannot be reached. g.mutex must be held.
+func (g *game) gameNode(address string) *node {
+	for _, n := range g.nodes {
+		if n.address == address && !n.dead {
+			return n
+		}
+	}
+	client, err := dialWorker(address)
+	if err != nil {
+		fmt.Printf("Dropping worker node %s: %s\n", address, err)
+		unregisterWorker(address)
+		return nil
+	}
+	n := &node{address: address, client: client}
+	g.nodes = append(g.nodes, n)
+	go g.heartbeat(n, g.stopHeartbeats)
+	return n
+}
+
+// Reports whether a game with a slice on each of own is already on nodes, one slice a node
+func sameNodes(nodes, own []string) bool {
+	if len(nodes) != len(own) {
+		return false
+	}
+	in := make(map[string]bool)
+	for _, address := range nodes {
+		in[address] = true
+	}
+	for _, address := range own {
+		if !in[address] {
+			return false
+		}
+		delete(in, address)
+	}
+	return true
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// slices makes a slice for each pair of rows and time per row
+func slices(bounds [][]int, rowTimes []float64) []*workerSlice {
+	var slices []*workerSlice
+	for i, b := range bounds {
+		slices = append(slices, &workerSlice{id: i, startY: b[0], endY: b[1], rowTime: rowTimes[i]})
+	}
+	return slices
+}
+
+func TestBalancedBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		bounds   [][]int
+		rowTimes []float64
+		height   int
+		want     [][]int // nil when the slices are left as they are
+	}{
+		{"one slice", [][]int{{0, 100}}, []float64{1e-3}, 100, nil},
+		{"unmeasured", [][]int{{0, 50}, {50, 100}}, []float64{1e-3, 0}, 100, nil},
+		{"equal", [][]int{{0, 50}, {50, 100}}, []float64{1e-3, 1e-3}, 100, nil},
+		{"equal, uneven rows", [][]int{{0, 33}, {33, 67}, {67, 100}}, []float64{1e-3, 1e-3, 1e-3}, 100, nil},
+		{"below the threshold", [][]int{{0, 50}, {50, 100}}, []float64{1e-3, 1.4e-3}, 100, nil},
+		{"too quick to time", [][]int{{0, 50}, {50, 100}}, []float64{1e-7, 1e-6}, 100, nil},
+		// the first slice's boundary would move 3 rows, inside the deadband
+		{"deadband", [][]int{{0, 30}, {30, 60}}, []float64{1e-3, 1.6e-3}, 60, nil},
+		// the fast slice would take 66 rows, it moves halfway there
+		{"slow slice", [][]int{{0, 50}, {50, 100}}, []float64{1e-3, 2e-3}, 100, [][]int{{0, 58}, {58, 100}}},
+		{"three slices", [][]int{{0, 40}, {40, 60}, {60, 100}}, []float64{1e-3, 1, 1e-3}, 100, [][]int{{0, 45}, {45, 55}, {55, 100}}},
+		// the middle slice's new end rounds down onto its new start, it keeps a row
+		{"one row", [][]int{{0, 10}, {10, 11}, {11, 100}}, []float64{1e-3, 1e6, 1 / 1032.52}, 100, [][]int{{0, 30}, {30, 31}, {31, 100}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bounds, changed := balancedBounds(slices(test.bounds, test.rowTimes), test.height)
+			if test.want == nil {
+				if changed {
+					t.Errorf("rows moved to %v", bounds)
+				}
+				return
+			}
+			if !changed || fmt.Sprint(bounds) != fmt.Sprint(test.want) {
+				t.Errorf("rows moved to %v (%v), want %v", bounds, changed, test.want)
+			}
+		})
+	}
+}
+
+func TestBalancedBoundsCoverWorld(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		n := 2 + random.Intn(6)
+		height := n + random.Intn(200)
+		// start from an even split with timings anywhere from a microsecond to a second a row
+		var bounds [][]int
+		var rowTimes []float64
+		for j := 0; j < n; j++ {
+			bounds = append(bounds, []int{j * height / n, (j + 1) * height / n})
+			rowTimes = append(rowTimes, 1e-6*float64(int(1)<<uint(random.Intn(20))))
+		}
+		moved, changed := balancedBounds(slices(bounds, rowTimes), height)
+		if !changed {
+			continue
+		}
+		start := 0
+		for _, b := range moved {
+			if b[0] != start || b[1] <= b[0] {
+				t.Fatalf("%d rows with timings %v were split into %v", height, rowTimes, moved)
+			}
+			start = b[1]
+		}
+		if start != height {
+			t.Fatalf("%d rows with timings %v were split into %v", height, rowTimes, moved)
+		}
+	}
+}
+
+func TestImbalancePersists(t *testing.T) {
+	g := &game{}
+	// one interval in balance starts the count again
+	intervals := []bool{true, true, false, true, true, true, true, true, true}
+	want := []bool{false, false, false, false, false, true, false, false, true}
+	for i, imbalanced := range intervals {
+		if got := g.imbalancePersists(imbalanced); got != want[i] {
+			t.Errorf("interval %d: rows moved is %v, want %v", i, got, want[i])
+		}
+	}
+}
+
+func TestShareNodes(t *testing.T) {
+	registered := []string{"a", "b", "c", "d"}
+	tests := []struct {
+		name  string
+		load  map[string]int // slices other games have on each node
+		own   []string
+		share int
+		want  []string
+	}{
+		{"starting alone", nil, nil, 4, []string{"a", "b", "c", "d"}},
+		{"starting beside a game", map[string]int{"a": 1, "b": 1, "c": 1, "d": 1}, nil, 2, []string{"a", "b"}},
+		{"making room", map[string]int{"a": 1, "b": 1}, []string{"a", "b", "c", "d"}, 2, []string{"c", "d"}},
+		{"already has its share", map[string]int{"a": 1, "b": 1}, []string{"c", "d"}, 2, []string{"c", "d"}},
+		// equally loaded nodes are not swapped for the ones the game is on
+		{"ties", map[string]int{"a": 1, "b": 1, "c": 1, "d": 1}, []string{"d", "b"}, 2, []string{"b", "d"}},
+		{"the other game finished", nil, []string{"c", "d"}, 4, []string{"c", "d", "a", "b"}},
+		{"more than registered", nil, nil, 6, []string{"a", "b", "c", "d"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := shareNodes(registered, test.load, test.own, test.share)
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSameNodes(t *testing.T) {
+	tests := []struct {
+		nodes, own []string
+		want       bool
+	}{
+		{[]string{"a", "b"}, []string{"b", "a"}, true},
+		{[]string{"a", "b"}, []string{"a"}, false},
+		{[]string{"a", "b"}, []string{"a", "c"}, false},
+		// two slices on one node are moved apart
+		{[]string{"a", "b"}, []string{"a", "a"}, false},
+	}
+	for _, test := range tests {
+		if got := sameNodes(test.nodes, test.own); got != test.want {
+			t.Errorf("sameNodes(%v, %v) is %v, want %v", test.nodes, test.own, got, test.want)
+		}
+	}
+}
+
+func TestSmoothRowTimes(t *testing.T) {
+	measured := &workerSlice{startY: 0, endY: 50, busy: 100 * time.Millisecond, busyTurns: 10, rowTime: 4e-4}
+	first := &workerSlice{startY: 50, endY: 100, busy: 100 * time.Millisecond, busyTurns: 10}
+	idle := &workerSlice{startY: 100, endY: 150, rowTime: 4e-4}
+	smoothRowTimes([]*workerSlice{measured, first, idle})
+
+	// 10ms a turn over 50 rows is 2e-4 a row
+	tests := []struct {
+		name string
+		ws   *workerSlice
+		want float64
+	}{
+		{"averaged with the last interval", measured, 3e-4},
+		{"first interval", first, 2e-4},
+		{"no turns since the last interval", idle, 4e-4},
+	}
+	for _, test := range tests {
+		if diff := test.ws.rowTime - test.want; diff > 1e-12 || diff < -1e-12 {
+			t.Errorf("%s: row time is %g, want %g", test.name, test.ws.rowTime, test.want)
+		}
+		if test.ws.busy != 0 || test.ws.busyTurns != 0 {
+			t.Errorf("%s: busy time was not reset", test.name)
+		}
+	}
+}
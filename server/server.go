@@ -1,57 +1,187 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/rpc"
+	"os"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"uk.ac.bris.cs/gameoflife/stubs"
 	"uk.ac.bris.cs/gameoflife/util"
 )
 
-var globalTurn int
-var globalWorld [][]uint8
-var globalAlive int
-var mutex sync.Mutex
-var clients []*rpc.Client
-var turnChannel = make(chan int)
-var flippedCellChannels = make(chan []util.Cell)
-
-func findAliveCellCount(world [][]uint8) int {
-	var length = len(world)
-	var count = 0
-	for col := 0; col < length; col++ {
-		for row := 0; row < length; row++ {
-			if world[col][row] == 255 {
-				count++
-			}
-		}
+var shutdown = make(chan int, 1)
+
+// errStopped is returned by the turn loop when the game was stopped by a shutdown
+var errStopped = errors.New("game stopped")
+var workers []string
+var workersMutex sync.Mutex
+var snapshotInterval int
+var abandonTimeout time.Duration
+
+const heartbeatInterval = time.Second
+const maxMissedHeartbeats = 3
+const shutdownGrace = 500 * time.Millisecond
+
+// controller is a client attached to a game, the broker pushes the game to it down the stream sub.
+// The attached one drives the game, any number of others can observe it without a say in it.
+type controller struct {
+	id       int
+	detached chan bool
+	sub      *subscriber
+}
+
+// Makes a controller or observer for the game, g.mutex must be held
+func (g *game) newController(req stubs.AttachRequest) *controller {
+	detached := make(chan bool)
+	sub := g.newSubscriber(req.ImageWidth, req.ImageHeight, req.FrameRate, req.Observer, detached)
+	return &controller{id: newControllerID(), detached: detached, sub: sub}
+}
+
+// Lets go of the attached controller, the game carries on without it
+func (g *game) detachController() {
+	if g.attached != nil {
+		close(g.attached.detached)
+		g.removeSubscriber(g.attached.sub)
+		g.attached = nil
+	}
+}
+
+func (g *game) detachObserver(id int) {
+	if o, ok := g.observers[id]; ok {
+		close(o.detached)
+		g.removeSubscriber(o.sub)
+		delete(g.observers, id)
+	}
+}
+
+// Lets go of a client whose stream broke without it detaching. A controller is detached and, unless another one
+// attaches within abandonTimeout, its game is stopped, as no one is left to stop it. g.mutex must be held.
+func (g *game) lostClient(c *controller) {
+	if _, ok := g.observers[c.id]; ok {
+		g.detachObserver(c.id)
+		return
+	}
+	if g.attached != c {
+		return
+	}
+	g.detachController()
+	fmt.Printf("Lost the controller of game %d at turn %d\n", g.id, g.turn)
+	if abandonTimeout > 0 {
+		g.lost = c.id
+		go g.abandon(c.id)
+	}
+}
+
+// Stops a game once abandonTimeout has passed since its controller went away, unless one has attached since. A game
+// that was never started is dropped. The stopped game is checkpointed if checkpoints are on, see CompleteTurn.
+func (g *game) abandon(id int) {
+	time.Sleep(abandonTimeout)
+	g.mutex.Lock()
+	if g.lost != id || g.attached != nil {
+		g.mutex.Unlock()
+		return
+	}
+	g.lost = 0
+	unstarted := g.done == nil
+	stopping := g.running && !g.isStopping()
+	if stopping {
+		fmt.Printf("Stopping game %d, its controller did not come back\n", g.id)
+		g.abandoned = true
+		close(g.stop)
+	}
+	g.mutex.Unlock()
+	if unstarted {
+		removeGame(g)
+	} else if stopping {
+		// unblocks any slice that is paused or waiting on a halo
+		g.stopSlices()
 	}
-	return count
+}
+
+// node is a connection to a worker node taking part in a game, each game has its own connections
+type node struct {
+	address string
+	client  *rpc.Client
+	dead    bool
+}
+
+// workerSlice is a band of rows and the node evolving it. The broker keeps the rows as they were at
+// snapshotTurn and every halo sent since, so the slice can be rebuilt on another node if its node dies.
+type workerSlice struct {
+	id           int
+	node         *node
+	startY       int
+	endY         int
+	snapshot     util.BitBoard
+	snapshotTurn int
+	reportedTurn int
+	busy         time.Duration // time the node has spent on the slice's turns since the last rebalance
+	busyTurns    int
+	rowTime      float64 // seconds the node takes over a row, averaged over the rebalances
 }
 
 type GameOfLifeOperation struct{}
 
-func workerNode(client *rpc.Client, startHeight, endHeight, width int, currentWorld [][]uint8, turns int, result chan [][]uint8) {
-	request := stubs.NodeRequest{Turns: turns, StartY: startHeight, EndY: endHeight, Width: width, CurrentWorld: currentWorld}
-	response := new(stubs.NodeResponse)
-	err := client.Call(stubs.ProcessSlice, request, response)
+func (g *game) workerNode(client *rpc.Client, request stubs.NodeRequest) {
+	defer g.slicesRunning.Done()
+	err := client.Call(stubs.ProcessSlice, request, new(stubs.NodeResponse))
 	if err != nil {
-		fmt.Println("Could not call worker node")
+		fmt.Println("Could not call worker node:", err)
+	}
+}
+
+// Returns the slices above and below a slice, wrapping round the edges of the world
+func (g *game) neighbours(ws *workerSlice) (*workerSlice, *workerSlice) {
+	for i := range g.workerSlices {
+		if g.workerSlices[i] == ws {
+			count := len(g.workerSlices)
+			return g.workerSlices[(i+count-1)%count], g.workerSlices[(i+1)%count]
+		}
 	}
-	result <- response.WorldSlice
+	return ws, ws
 }
 
-func getWorkerSlices(req stubs.Request)[][]int{
+func neighbour(ws *workerSlice) stubs.Neighbour {
+	return stubs.Neighbour{Address: ws.node.address, Slice: ws.id}
+}
+
+// Builds the request that (re)starts a slice from its snapshot
+func (g *game) nodeRequest(ws *workerSlice, req stubs.Request) stubs.NodeRequest {
+	up, down := g.neighbours(ws)
+	return stubs.NodeRequest{
+		Game:             g.id,
+		Slice:            ws.id,
+		Turns:            req.Turns,
+		Threads:          req.Threads,
+		Rule:             req.Rule,
+		Boundary:         req.Boundary,
+		ImageHeight:      req.ImageHeight,
+		StartTurn:        ws.snapshotTurn,
+		ReportFrom:       ws.reportedTurn + 1,
+		SnapshotInterval: snapshotInterval,
+		StartY:           ws.startY,
+		EndY:             ws.endY,
+		Up:               neighbour(up),
+		Down:             neighbour(down),
+		CurrentWorld:     ws.snapshot,
+	}
+}
+
+func getWorkerSlices(height, workerCount int) [][]int {
 	var slices [][]int
-	workerHeight := req.ImageHeight / len(req.Workers)
-	for j := 0; j < len(req.Workers); j++ {
+	workerHeight := height / workerCount
+	for j := 0; j < workerCount; j++ {
 		startHeight := workerHeight * j
 		endHeight := workerHeight * (j + 1)
-		if j == len(req.Workers)-1 { // send the extra part when workerHeight is not a whole number in last iteration
-			endHeight += req.ImageHeight % len(req.Workers)
+		if j == workerCount-1 { // send the extra part when workerHeight is not a whole number in last iteration
+			endHeight += height % workerCount
 		}
 		slices = append(slices, []int{startHeight, endHeight})
 	}
@@ -59,225 +189,893 @@ func getWorkerSlices(req stubs.Request)[][]int{
 	return slices
 }
 
-func sendWorkers(req stubs.Request) [][]uint8 {
+// Splits the world between the nodes and starts every slice, nodes beyond the height of the world are kept as spares
+func (g *game) sendWorkers(req stubs.Request, world util.BitBoard, turn int) {
+	workerCount := len(g.nodes)
+	if workerCount > req.ImageHeight {
+		workerCount = req.ImageHeight
+	}
 
-	var newPixelData [][]uint8
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.splitRows(g.nodes[:workerCount], req.ImageHeight, world, turn)
+	g.startSlices(req, world, turn)
+}
 
-	responses := make([]chan [][]uint8, len(req.Workers))
-	for i := 0; i < len(req.Workers); i++ {
-		responses[i] = make(chan [][]uint8)
+// Splits the rows of the world at a turn evenly into a slice for each node, g.mutex must be held
+func (g *game) splitRows(nodes []*node, height int, world util.BitBoard, turn int) {
+	g.workerSlices = nil
+	for j, slice := range getWorkerSlices(height, len(nodes)) {
+		ws := &workerSlice{
+			id:           newSliceID(),
+			node:         nodes[j],
+			startY:       slice[0],
+			endY:         slice[1],
+			snapshot:     world.Rows(slice[0], slice[1]),
+			snapshotTurn: turn,
+			reportedTurn: turn,
+		}
+		g.workerSlices = append(g.workerSlices, ws)
 	}
+}
 
-	workerSlices := getWorkerSlices(req)
-	for j, slices := range workerSlices{
-		go workerNode(clients[j], slices[0], slices[1], req.ImageWidth, req.InitialWorld[slices[0]:slices[1]], req.Turns, responses[j])
+// Starts every slice of the game from the world at a turn, g.mutex must be held
+func (g *game) startSlices(req stubs.Request, world util.BitBoard, turn int) {
+	if turn >= req.Turns {
+		return
+	}
+	for _, ws := range g.workerSlices {
+		request := g.nodeRequest(ws, req)
+		request.FromAbove = [][]uint64{world.Row((ws.startY + req.ImageHeight - 1) % req.ImageHeight)}
+		request.FromBelow = [][]uint64{world.Row(ws.endY % req.ImageHeight)}
+		g.slicesRunning.Add(1)
+		go g.workerNode(ws.node.client, request)
 	}
+}
 
-	for k := 0; k < len(req.Workers); k++ {
-		result := <-responses[k]
-		newPixelData = append(newPixelData, result...)
+// Joins the latest snapshot of every slice back into a whole world
+func (g *game) assembleWorld() util.BitBoard {
+	var bands []util.BitBoard
+	for _, ws := range g.workerSlices {
+		bands = append(bands, ws.snapshot)
 	}
+	return util.JoinBitBoards(bands)
+}
 
-	return newPixelData
+func dialWorker(address string) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", address, heartbeatInterval)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
 }
 
-func makeWorkerConnectionsAndChannels(workers []string) []*rpc.Client {
-	var clientConnections []*rpc.Client
-	for i := 0; i < len(workers); i++ {
-		client, errors := rpc.Dial("tcp", workers[i])
-		if errors != nil {
-			fmt.Println(errors)
+// Dials the nodes a game has been given, nodes that can no longer be reached are dropped from the registry
+func makeWorkerConnectionsAndChannels(addresses []string) []*node {
+	var connections []*node
+	for _, worker := range addresses {
+		client, err := dialWorker(worker)
+		if err != nil {
+			fmt.Printf("Dropping worker node %s: %s\n", worker, err)
+			unregisterWorker(worker)
+			continue
 		}
-		clientConnections = append(clientConnections, client)
+		connections = append(connections, &node{address: worker, client: client})
 	}
-	return clientConnections
+	return connections
 }
 
-func closeWorkerConnections() {
-	for _, client := range clients {
-		err := client.Close()
+func (g *game) closeWorkerConnections() {
+	// the last reports can arrive before ProcessSlice returns, so wait for it rather than cut it off
+	g.slicesRunning.Wait()
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, n := range g.nodes {
+		if n.dead {
+			continue
+		}
+		err := n.client.Close()
 		if err != nil {
 			fmt.Println(err)
 		}
 	}
+	g.nodes = nil
+	g.workerSlices = nil
 }
 
-func flipCellHandler(turns int) {
-	for i := 0; i < turns; i++ {
-		var flippedCell []util.Cell
-		for _, client := range clients {
-			response := new(stubs.FlippedCellResponse)
-			client.Call(stubs.GetFlippedCells, stubs.EmptyRequest{}, response)
-			flippedCell = append(flippedCell, response.FlippedCells...)
+// Stops every slice of the game that is still running, used when a game has to be abandoned
+func (g *game) stopSlices() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, ws := range g.workerSlices {
+		if !ws.node.dead {
+			ws.node.client.Call(stubs.StopSlice, stubs.SliceRequest{Slice: ws.id}, &stubs.EmptyResponse{})
 		}
-		flippedCellChannels <- flippedCell
 	}
 }
 
-//Collects all the halo regions of the initial world and sends it to sendHalo
-func sendInitialHalo(req stubs.Request) {
-
-	workerSlices := getWorkerSlices(req)
-	var halos []stubs.HaloResponse
-	for _, slice := range  workerSlices{
-		h1 := req.InitialWorld[slice[0]]
-		h2 := req.InitialWorld[slice[1]-1]
-		halos = append(halos, stubs.HaloResponse{FirstHalo: h1, LastHalo: h2})
+func unregisterWorker(address string) {
+	workersMutex.Lock()
+	defer workersMutex.Unlock()
+	for i, worker := range workers {
+		if worker == address {
+			workers = append(workers[:i], workers[i+1:]...)
+			return
+		}
 	}
-	sendHalo(halos)
+}
 
+// Closing the connection makes any call still waiting on the node fail, which hands its slices to another node
+func (g *game) markDead(n *node) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if n.dead {
+		return
+	}
+	n.dead = true
+	n.client.Close()
+	unregisterWorker(n.address)
+	fmt.Println("Lost worker node", n.address)
 }
 
-//func to take all slices and arrange it to clients in order
-func haloExchange(oldHalos []stubs.HaloResponse) []stubs.HaloResponse { //if 2 stubs.Haloresponses
-	var newHalos []stubs.HaloResponse
-	size := len(oldHalos) - 1
-	if size == 0 {
-		newHalos = append(newHalos, stubs.HaloResponse{FirstHalo: oldHalos[0].LastHalo, LastHalo: oldHalos[0].FirstHalo})
-	} else {
-		for i := range oldHalos {
-			var halo stubs.HaloResponse
-			if i == 0 {
-				halo = stubs.HaloResponse{FirstHalo:  oldHalos[size].LastHalo, LastHalo: oldHalos[i+1].FirstHalo}
-			} else if i == size {
-				halo = stubs.HaloResponse{FirstHalo:  oldHalos[size-1].LastHalo, LastHalo: oldHalos[0].FirstHalo}
+// Pings a node every heartbeatInterval and marks it dead once it misses too many in a row
+func (g *game) heartbeat(n *node, stop chan bool) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		call := n.client.Go(stubs.Heartbeat, stubs.EmptyRequest{}, &stubs.EmptyResponse{}, nil)
+		select {
+		case <-call.Done:
+			if call.Error != nil {
+				missed = maxMissedHeartbeats
 			} else {
-				halo = stubs.HaloResponse{FirstHalo:  oldHalos[i-1].LastHalo, LastHalo: oldHalos[i+1].FirstHalo}
+				missed = 0
 			}
-			newHalos = append(newHalos, halo)
+		case <-time.After(heartbeatInterval):
+			missed++
+		}
+		// the game can end while the call is out, closing the client under it, which is not the node's fault
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if missed >= maxMissedHeartbeats {
+			g.markDead(n)
+			return
 		}
 	}
-	return newHalos
 }
 
-func sendHalo(halos []stubs.HaloResponse) {
-	halo := haloExchange(halos)
-	for index, client := range clients {
-		err := client.Call(stubs.SendHaloToNode, halo[index], &stubs.EmptyResponse{})
+// Finds a node to take over a slice, preferring the least loaded registered node that is not in the game yet
+// and otherwise the game's live node with the fewest slices
+func (g *game) pickReplacement() *node {
+	workersMutex.Lock()
+	registered := append([]string(nil), workers...)
+	workersMutex.Unlock()
+	load, _ := nodeLoad()
+	sort.SliceStable(registered, func(i, j int) bool {
+		return load[registered[i]] < load[registered[j]]
+	})
+
+	g.mutex.Lock()
+	inGame := make(map[string]bool)
+	for _, n := range g.nodes {
+		inGame[n.address] = true
+	}
+	g.mutex.Unlock()
+
+	for _, address := range registered {
+		if inGame[address] {
+			continue
+		}
+		client, err := dialWorker(address)
 		if err != nil {
-			return
+			unregisterWorker(address)
+			continue
 		}
+		n := &node{address: address, client: client}
+		g.mutex.Lock()
+		g.nodes = append(g.nodes, n)
+		if g.paused || g.rebalanceTurn > 0 {
+			runTo := g.pauseTurn
+			if g.rebalanceTurn > 0 {
+				runTo = g.rebalanceTurn
+			}
+			client.Call(stubs.PauseAndResumeNode, stubs.PauseRequest{Game: g.id, Command: "PAUSE"}, &stubs.PauseResponse{})
+			client.Call(stubs.PauseAndResumeNode, stubs.PauseRequest{Game: g.id, Command: "RUNTO", Turn: runTo}, &stubs.PauseResponse{})
+		}
+		g.mutex.Unlock()
+		go g.heartbeat(n, g.stopHeartbeats)
+		return n
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	slices := make(map[*node]int)
+	for _, ws := range g.workerSlices {
+		slices[ws.node]++
+	}
+	var best *node
+	for _, n := range g.nodes {
+		if !n.dead && (best == nil || slices[n] < slices[best]) {
+			best = n
+		}
+	}
+	return best
+}
+
+// Restarts a slice whose node died from its last snapshot, the new node replays the halos it missed
+func (g *game) reassignSlice(ws *workerSlice, req stubs.Request) error {
+	n := g.pickReplacement()
+	if n == nil {
+		return errors.New("no worker nodes left to take over rows " + fmt.Sprint(ws.startY, "-", ws.endY))
+	}
+	g.mutex.Lock()
+	ws.node = n
+	ws.id = newSliceID()
+	ws.busy, ws.busyTurns, ws.rowTime = 0, 0, 0
+	request := g.nodeRequest(ws, req)
+	up, down := g.neighbours(ws)
+	g.mutex.Unlock()
+
+	if up == ws {
+		// the slice is the whole world so its own edges are its halos
+		request.FromAbove = [][]uint64{ws.snapshot.Row(ws.snapshot.Height - 1)}
+		request.FromBelow = [][]uint64{ws.snapshot.Row(0)}
+	} else {
+		request.FromAbove = redirect(up, ws, true)
+		request.FromBelow = redirect(down, ws, false)
+	}
+
+	fmt.Printf("Moving rows %d-%d to worker node %s from turn %d\n", ws.startY, ws.endY, n.address, ws.snapshotTurn)
+	g.slicesRunning.Add(1)
+	go g.workerNode(n.client, request)
+	return nil
+}
+
+func (g *game) collectReport(ws *workerSlice, req stubs.Request) (stubs.TurnReport, error) {
+	for {
+		report := new(stubs.TurnReport)
+		err := ws.node.client.Call(stubs.GetTurnReport, stubs.SliceRequest{Slice: ws.id, KeepFrom: g.oldestSnapshot()}, report)
+		if err == nil {
+			return *report, nil
+		}
+		if g.isStopping() {
+			return stubs.TurnReport{}, errStopped
+		}
+		fmt.Printf("Could not get turn report from worker node %s: %s\n", ws.node.address, err)
+		g.markDead(ws.node)
+		if err := g.reassignSlice(ws, req); err != nil {
+			return stubs.TurnReport{}, err
+		}
+	}
+}
+
+// Points the neighbour of a moved slice at its new node and returns the rows the neighbour has sent it
+// since its snapshot. If the neighbour is gone as well its snapshot has to do, and its own replacement sends the rest.
+func redirect(neighbour, ws *workerSlice, above bool) [][]uint64 {
+	request := stubs.RedirectRequest{
+		Slice:     neighbour.id,
+		Up:        !above,
+		Neighbour: stubs.Neighbour{Address: ws.node.address, Slice: ws.id},
+		From:      ws.snapshotTurn,
 	}
+	res := new(stubs.RedirectResponse)
+	err := neighbour.node.client.Call(stubs.Redirect, request, res)
+	if err == nil {
+		return res.Halos
+	}
+	fmt.Printf("Could not redirect worker node %s: %s\n", neighbour.node.address, err)
+	if neighbour.snapshotTurn != ws.snapshotTurn {
+		return nil
+	}
+	if above {
+		return [][]uint64{neighbour.snapshot.Row(neighbour.snapshot.Height - 1)}
+	}
+	return [][]uint64{neighbour.snapshot.Row(0)}
 }
 
-func haloWorker(turns int, req stubs.Request) {
+// Returns the oldest snapshot turn, nodes need to keep the edge rows they sent after it
+func (g *game) oldestSnapshot() int {
+	oldest := g.workerSlices[0].snapshotTurn
+	for _, ws := range g.workerSlices {
+		if ws.snapshotTurn < oldest {
+			oldest = ws.snapshotTurn
+		}
+	}
+	return oldest
+}
 
-	sendInitialHalo(req)
-	for i := 0; i < turns; i++ {
-		var haloResponses []stubs.HaloResponse
-		for _, client := range clients {
-			response := new(stubs.HaloResponse)
-			err := client.Call(stubs.SendHaloToBroker, stubs.EmptyRequest{}, response)
+func (g *game) turnWorker(req stubs.Request, startTurn int) error {
+	for turn := startTurn + 1; turn <= req.Turns; turn++ {
+		if g.isStopping() {
+			return errStopped
+		}
+		var flipped []util.Cell
+		alive := 0
+		for _, ws := range g.workerSlices {
+			report, err := g.collectReport(ws, req)
 			if err != nil {
-				return
+				return err
 			}
-			haloResponses = append(haloResponses, *response)
+			if report.WorldSlice.Height > 0 {
+				ws.snapshot = report.WorldSlice
+				ws.snapshotTurn = turn
+			}
+			ws.reportedTurn = turn
+			ws.busy += report.Busy
+			ws.busyTurns++
+			flipped = append(flipped, report.FlippedCells...)
+			alive += report.NumOfAliveCells
+		}
+
+		g.checkpointIfDue(req, turn)
+
+		g.mutex.Lock()
+		for _, cell := range flipped {
+			g.world.Flip(cell.X, cell.Y)
 		}
-		sendHalo(haloResponses)
+		g.alive = alive
+		g.turn = turn
+		everyTurn := g.gatherFlipped(turn, flipped)
+		g.mutex.Unlock()
+
+		for _, sub := range everyTurn {
+			sub.send(stubs.StreamMessage{Kind: stubs.TurnMessage, Turn: turn, FlippedCells: flipped})
+		}
+
+		if rebalanceInterval > 0 && turn < req.Turns {
+			g.rebalance(req, turn)
+		}
+	}
+	return nil
+}
+
+// Blocks until the game finishes and returns its final world
+func (g *game) waitForGame(res *stubs.Response) error {
+	g.mutex.Lock()
+	done := g.done
+	g.mutex.Unlock()
+	if done == nil {
+		return fmt.Errorf("game %d has not been started", g.id)
 	}
+	<-done
+	g.mutex.Lock()
+	res.World = g.world.Copy()
+	res.Turn = g.turn
+	g.mutex.Unlock()
+	return nil
 }
 
-func getTurnsAndCellCount(turns int) {
+// CompleteTurn starts the game Attach gave the controller and replies with its final world once it finishes.
+// With GameStatus "ATTACH" it waits for a game that is already running instead.
+func (s *GameOfLifeOperation) CompleteTurn(req stubs.Request, res *stubs.Response) (err error) {
+	g, err := findGame(req.Game)
+	if err != nil {
+		return err
+	}
+	res.Game = g.id
+	if req.GameStatus == "ATTACH" {
+		return g.waitForGame(res)
+	}
+	if req.Rule == "" {
+		req.Rule = util.DefaultRule
+	}
+	if req.Boundary == "" {
+		req.Boundary = util.Torus
+	}
+	if _, err := util.ParseRule(req.Rule); err != nil {
+		return err
+	}
+	if err := util.CheckBoundary(req.Boundary); err != nil {
+		return err
+	}
+
+	g.mutex.Lock()
+	if err := g.checkController(req.Controller); err != nil {
+		g.mutex.Unlock()
+		return err
+	}
+	if g.done != nil {
+		g.mutex.Unlock()
+		return fmt.Errorf("game %d has already been started", g.id)
+	}
+	g.running = true
+	g.done = make(chan bool)
+	g.stop = make(chan bool)
+	g.mutex.Unlock()
+	defer func() {
+		g.mutex.Lock()
+		g.running = false
+		close(g.done)
+		g.detachController()
+		for id := range g.observers {
+			g.detachObserver(id)
+		}
+		g.mutex.Unlock()
+		removeGame(g)
+	}()
 
-	for i := 0; i < turns; i++ {
-		response := new(stubs.TurnResponse)
-		var alive = 0
-		for _, client := range clients {
-			client.Call(stubs.GetTurnAndAliveCell, stubs.EmptyRequest{}, response)
-			alive += response.NumOfAliveCells
+	world := req.InitialWorld
+	startTurn := 0
+	if req.GameStatus == "RESUME" {
+		cp, dir, err := loadCheckpoint(req.ImageWidth, req.ImageHeight)
+		if err != nil {
+			return err
 		}
-		mutex.Lock()
-		globalAlive = alive
-		globalTurn = response.Turn
-		turnChannel <- response.Turn
-		mutex.Unlock()
+		world = cp.World
+		startTurn = cp.Turn
+		// a game keeps the rule and boundary it was started with
+		if cp.Rule != "" {
+			req.Rule = cp.Rule
+		}
+		if cp.Boundary != "" {
+			req.Boundary = cp.Boundary
+		}
+		g.resumedFrom = dir
+		fmt.Printf("Resuming game %d from checkpoint at turn %d\n", g.id, startTurn)
+	}
 
+	g.mutex.Lock()
+	g.lastCheckpoint = startTurn
+	g.request = stubs.Request{Turns: req.Turns, Threads: req.Threads, ImageWidth: req.ImageWidth, ImageHeight: req.ImageHeight, Rule: req.Rule, Boundary: req.Boundary}
+	g.world = world.Copy()
+	g.alive = g.world.Count()
+	g.turn = startTurn
+	g.mutex.Unlock()
+	nodes := makeWorkerConnectionsAndChannels(scheduleWorkers())
+	if len(nodes) == 0 {
+		return errors.New("no worker nodes are registered with the broker")
+	}
+	fmt.Printf("Starting game %d on %d worker nodes\n", g.id, len(nodes))
+
+	g.mutex.Lock()
+	g.nodes = nodes
+	g.stopHeartbeats = make(chan bool)
+	for _, n := range g.nodes {
+		go g.heartbeat(n, g.stopHeartbeats)
+	}
+	g.mutex.Unlock()
+	stopAlive := make(chan bool)
+	go g.publishAlive(stopAlive)
+	defer close(stopAlive)
+
+	g.sendWorkers(req, world, startTurn)
+	err = g.turnWorker(req, startTurn)
+	close(g.stopHeartbeats)
+	if err == errStopped {
+		// the broker's copy of the world is complete up to the last turn every slice reported
+		g.mutex.Lock()
+		res.World = g.world.Copy()
+		res.Turn = g.turn
+		if g.abandoned && checkpointInterval > 0 {
+			// no one is left to save the world, so it is kept to resume from
+			err := g.saveCheckpoint(g.request, g.turn, g.world)
+			if err != nil {
+				fmt.Println("Could not save checkpoint:", err)
+			}
+		}
+		g.mutex.Unlock()
+		g.closeWorkerConnections()
+		return nil
+	}
+	if err != nil {
+		g.stopSlices()
+		g.closeWorkerConnections()
+		return err
 	}
+
+	res.World = g.assembleWorld()
+	res.Turn = req.Turns
+	g.closeWorkerConnections()
+	// a finished game has nothing left to resume
+	g.clearCheckpoints()
+	return
 }
 
-func (s *GameOfLifeOperation) CompleteTurn(req stubs.Request, res *stubs.Response) (err error) {
+// Tells every registered node to exit, returns false if any of them could not be reached
+func shutdownWorkers() bool {
+	workersMutex.Lock()
+	registered := append([]string(nil), workers...)
+	workers = nil
+	workersMutex.Unlock()
 
-	globalWorld = req.InitialWorld
-	globalAlive = findAliveCellCount(globalWorld)
+	ok := true
+	for _, worker := range registered {
+		client, err := dialWorker(worker)
+		if err == nil {
+			err = client.Call(stubs.ShutdownNode, stubs.EmptyRequest{}, &stubs.EmptyResponse{})
+			client.Close()
+		}
+		if err != nil {
+			fmt.Printf("Could not shut down worker node %s: %s\n", worker, err)
+			ok = false
+		}
+	}
+	return ok
+}
 
-	clients = makeWorkerConnectionsAndChannels(req.Workers)
+// Shutdown stops the controller's game where it is, the controller gets the world at the turn the game stopped on
+// as the reply to CompleteTurn. Once no other game is running it shuts every node down and then exits the broker.
+func (s *GameOfLifeOperation) Shutdown(req stubs.ControllerRequest, res *stubs.EmptyResponse) (err error) {
+	g, err := findGame(req.Game)
+	if err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	if err := g.checkController(req.Controller); err != nil {
+		g.mutex.Unlock()
+		return err
+	}
+	fmt.Println("Stopping game", g.id)
+	done := g.done
+	if g.running && !g.isStopping() {
+		close(g.stop)
+	}
+	g.mutex.Unlock()
 
-	go flipCellHandler(req.Turns)
-	go getTurnsAndCellCount(req.Turns)
-	go haloWorker(req.Turns, req)
+	if done != nil {
+		// unblocks any slice that is paused or waiting on a halo
+		g.stopSlices()
+		<-done
+	} else {
+		removeGame(g)
+	}
 
-	final := sendWorkers(req)
+	if _, running := nodeLoad(); running > 0 {
+		fmt.Println("Other games are still running, leaving the broker up")
+		return
+	}
+	fmt.Println("Shutting down")
+	code := 0
+	if !shutdownWorkers() {
+		code = 1
+	}
+	shutdown <- code
+	return
+}
 
-	res.World = final
-	closeWorkerConnections()
+// Attach makes the caller the controller of a game, replacing any other. If the game is running it gets the
+// current world, otherwise it should start the game which it will then be the controller of.
+func (s *GameOfLifeOperation) Attach(req stubs.AttachRequest, res *stubs.AttachResponse) (err error) {
+	if req.FrameRate < 0 || req.FrameRate > stubs.MaxFrameRate {
+		return fmt.Errorf("the frame rate has to be between 0 and %d", stubs.MaxFrameRate)
+	}
+	var g *game
+	if req.Game > 0 {
+		g, err = findGame(req.Game)
+	} else {
+		g, err = pickGame(req)
+	}
+	if err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.running && (req.ImageWidth != g.request.ImageWidth || req.ImageHeight != g.request.ImageHeight) {
+		return fmt.Errorf("game %d is %dx%d", g.id, g.request.ImageWidth, g.request.ImageHeight)
+	}
+	res.Game = g.id
+	if req.Observer {
+		if !g.running {
+			return fmt.Errorf("game %d is not running yet", g.id)
+		}
+		o := g.newController(req)
+		g.observers[o.id] = o
+		res.Controller = o.id
+		fmt.Printf("Observer attached to game %d at turn %d\n", g.id, g.turn)
+	} else {
+		g.detachController()
+		g.attached = g.newController(req)
+		g.lost = 0
+		res.Controller = g.attached.id
+	}
+	res.Stream = streamPort
+	if !g.running {
+		return
+	}
+	res.Running = true
+	res.Paused = g.paused
+	res.Turn = g.turn
+	res.Turns = g.request.Turns
+	res.World = g.world.Copy()
+	if !req.Observer {
+		fmt.Printf("Controller attached to game %d at turn %d\n", g.id, g.turn)
+	}
 	return
 }
 
-func (s *GameOfLifeOperation) AliveCellGetter(req stubs.EmptyRequest, res *stubs.TurnResponse) (err error) {
-	mutex.Lock()
-	res.Turn = globalTurn
-	res.NumOfAliveCells = globalAlive
-	mutex.Unlock()
+// Detach lets the controller or an observer leave while the game keeps running. A game whose controller leaves
+// before starting it is dropped.
+func (s *GameOfLifeOperation) Detach(req stubs.ControllerRequest, res *stubs.EmptyResponse) (err error) {
+	g, err := findGame(req.Game)
+	if err != nil {
+		// the game has finished, which detached everyone already
+		return nil
+	}
+	g.mutex.Lock()
+	if g.attached != nil && g.attached.id == req.Controller {
+		g.detachController()
+		fmt.Printf("Controller detached from game %d at turn %d\n", g.id, g.turn)
+	} else if _, ok := g.observers[req.Controller]; ok {
+		g.detachObserver(req.Controller)
+		fmt.Printf("Observer detached from game %d at turn %d\n", g.id, g.turn)
+	}
+	unstarted := g.done == nil && g.attached == nil
+	g.mutex.Unlock()
+	if unstarted {
+		removeGame(g)
+	}
 	return
 }
 
-func (s *GameOfLifeOperation) GetWorld(req stubs.EmptyRequest, res *stubs.WorldResponse) (err error) {
+// GetCheckpoint returns the newest checkpoint of a world the size asked for, so a client can show where a
+// resumed game starts from
+func (s *GameOfLifeOperation) GetCheckpoint(req stubs.CheckpointRequest, res *stubs.CheckpointResponse) (err error) {
+	cp, _, err := loadCheckpoint(req.ImageWidth, req.ImageHeight)
+	if err != nil {
+		return err
+	}
+	res.Turn = cp.Turn
+	res.ImageWidth = cp.ImageWidth
+	res.ImageHeight = cp.ImageHeight
+	res.Rule = cp.Rule
+	res.Boundary = cp.Boundary
+	res.World = cp.World
+	return
+}
 
-	var newWorld [][]uint8
-	for i, client := range clients{
-		response := new(stubs.NodeResponse)
-		err := client.Call(stubs.GetNode, req, response)
-		if err != nil {
-			fmt.Printf("Could not get world of worker number %d\n", i)
-			return err
+// RegisterWorker is called by a node on startup so the broker can hand it slices of the next games
+func (s *GameOfLifeOperation) RegisterWorker(req stubs.RegisterRequest, res *stubs.EmptyResponse) (err error) {
+	workersMutex.Lock()
+	defer workersMutex.Unlock()
+	for _, worker := range workers {
+		if worker == req.Address {
+			return
 		}
-		newWorld = append(newWorld, response.WorldSlice...)
 	}
+	workers = append(workers, req.Address)
+	fmt.Println("Registered worker node", req.Address)
+	return
+}
 
-	mutex.Lock()
-	globalWorld = newWorld
-	res.World = globalWorld //make a function to call all nodes and get their slices and make into 1
-	mutex.Unlock()
+func (s *GameOfLifeOperation) AliveCellGetter(req stubs.TurnRequest, res *stubs.TurnResponse) (err error) {
+	g, err := findGame(req.Game)
+	if err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	res.Turn = g.turn
+	res.NumOfAliveCells = g.alive
+	g.mutex.Unlock()
 	return
 }
 
-//GetWorldPerTurn FUNCTION NEED TO CHANGE
-func (s *GameOfLifeOperation) GetWorldPerTurn(req stubs.EmptyRequest, res *stubs.SdlResponse) (err error) {
-	for i := 0; i < 2; i++ {
-		select {
-		case turn := <-turnChannel:
-			res.Turn = turn
-		case flipped := <-flippedCellChannels:
-			res.FlippedCells = flipped
+func (s *GameOfLifeOperation) GetWorld(req stubs.GameRequest, res *stubs.WorldResponse) (err error) {
+	g, err := findGame(req.Game)
+	if err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	res.World = g.world.Copy()
+	g.mutex.Unlock()
+	return
+}
+
+// EditCells flips cells of the paused game. The broker first waits for the reports of every turn up to the one
+// the game is paused on, then has the nodes flip the cells in their slices at that turn. An edited slice's
+// snapshot is moved on to the edited rows, so a node that dies afterwards does not lose the edit.
+// The flipped cells are published like a turn's, so every subscriber sees the edit.
+func (s *GameOfLifeOperation) EditCells(req stubs.CellsRequest, res *stubs.PauseResponse) (err error) {
+	g, err := findGame(req.Game)
+	if err != nil {
+		return err
+	}
+	var edited []util.Cell
+	var everyTurn []*subscriber
+	defer func() {
+		for _, sub := range everyTurn {
+			sub.send(stubs.StreamMessage{Kind: stubs.TurnMessage, Turn: res.Turn, FlippedCells: edited})
 		}
+	}()
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if err := g.checkController(req.Controller); err != nil {
+		return err
+	}
+	for g.running && g.paused && g.turn < g.pauseTurn {
+		g.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		g.mutex.Lock()
+	}
+	if !g.running || !g.paused {
+		return errors.New("the game has to be paused to edit it")
+	}
+
+	edits := make(map[*workerSlice][]util.Cell)
+	for _, cell := range req.Cells {
+		if cell.X < 0 || cell.Y < 0 || cell.X >= g.request.ImageWidth || cell.Y >= g.request.ImageHeight {
+			return fmt.Errorf("cell (%d, %d) is outside the world", cell.X, cell.Y)
+		}
+		for _, ws := range g.workerSlices {
+			if cell.Y >= ws.startY && cell.Y < ws.endY {
+				edits[ws] = append(edits[ws], util.Cell{X: cell.X, Y: cell.Y - ws.startY})
+			}
+		}
+	}
+	for ws, cells := range edits {
+		if ws.node.dead {
+			return fmt.Errorf("the node with rows %d to %d is being replaced, try again", ws.startY, ws.endY)
+		}
+		err := ws.node.client.Call(stubs.EditCellsNode, stubs.EditRequest{Slice: ws.id, Turn: g.pauseTurn, Cells: cells}, &stubs.EmptyResponse{})
+		if err != nil {
+			return err
+		}
+		var flipped []util.Cell
+		for _, cell := range cells {
+			g.world.Flip(cell.X, cell.Y+ws.startY)
+			flipped = append(flipped, util.Cell{X: cell.X, Y: cell.Y + ws.startY})
+		}
+		g.alive = g.world.Count()
+		res.Turn = g.pauseTurn
+		everyTurn = g.gatherFlipped(g.pauseTurn, flipped)
+		edited = append(edited, flipped...)
+		ws.snapshot = g.world.Rows(ws.startY, ws.endY).Copy()
+		ws.snapshotTurn = g.pauseTurn
 	}
 	return
 }
 
-func (s *GameOfLifeOperation) PauseAndResume(req stubs.PauseRequest, res *stubs.EmptyResponse) (err error){
-	for i, client := range clients{
-		err := client.Call(stubs.PauseAndResumeNode, req, &stubs.EmptyResponse{})
+// Sends a pause command for the game to each of its live nodes, returning the furthest turn any of them replies with
+func (g *game) pauseNodes(req stubs.PauseRequest) (int, error) {
+	req.Game = g.id
+	furthest := 0
+	for i, n := range g.nodes {
+		if n.dead {
+			continue
+		}
+		nodeRes := new(stubs.PauseResponse)
+		err := n.client.Call(stubs.PauseAndResumeNode, req, nodeRes)
 		if err != nil {
 			fmt.Printf("Couldnt not pause / resume worker number %d\n", i)
+			return furthest, err
+		}
+		if nodeRes.Turn > furthest {
+			furthest = nodeRes.Turn
+		}
+	}
+	return furthest, nil
+}
+
+// PauseAndResume pauses, resumes or steps a game. Slices run ahead of each other, so pausing first stops
+// every node and then lets them all catch up to the furthest turn any of them had started, which is the turn
+// the game pauses on. STEP moves that turn on by req.Turns. Pausing and resuming are published to every subscriber.
+// The other games on the broker carry on.
+func (s *GameOfLifeOperation) PauseAndResume(req stubs.PauseRequest, res *stubs.PauseResponse) (err error) {
+	g, err := findGame(req.Game)
+	if err != nil {
+		return err
+	}
+	changed := false
+	defer func() {
+		if changed {
+			g.publish(stubs.StreamMessage{Kind: stubs.StateMessage, Turn: res.Turn, Paused: req.Command == "PAUSE"})
+		}
+	}()
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if err := g.checkController(req.Controller); err != nil {
+		return err
+	}
+	// the nodes are held while rows are moved between them, which has to finish first
+	for g.running && g.rebalanceTurn > 0 {
+		g.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		g.mutex.Lock()
+	}
+	switch req.Command {
+	case "PAUSE":
+		if g.paused {
+			break
+		}
+		g.paused = true
+		changed = true
+		furthest, err := g.pauseNodes(req)
+		if err != nil {
 			return err
 		}
+		if furthest < g.turn {
+			furthest = g.turn
+		}
+		g.pauseTurn = furthest
+		_, err = g.pauseNodes(stubs.PauseRequest{Command: "RUNTO", Turn: g.pauseTurn})
+		if err != nil {
+			return err
+		}
+	case "STEP":
+		if !g.paused {
+			return errors.New("the game has to be paused to step it")
+		}
+		if req.Turns < 1 {
+			req.Turns = 1
+		}
+		g.pauseTurn += req.Turns
+		if g.running && g.pauseTurn > g.request.Turns {
+			g.pauseTurn = g.request.Turns
+		}
+		_, err = g.pauseNodes(stubs.PauseRequest{Command: "RUNTO", Turn: g.pauseTurn})
+		if err != nil {
+			return err
+		}
+	case "RESUME":
+		changed = g.paused
+		g.paused = false
+		_, err = g.pauseNodes(req)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown command %q", req.Command)
+	}
+	res.Turn = g.turn
+	if g.paused {
+		res.Turn = g.pauseTurn
 	}
 	return
 }
 
 func main() {
 	pAddr := flag.String("port", "8003", "Port to listen on")
+	flag.StringVar(&streamPort, "stream", "", "Port to take stream connections on, defaults to the one after -port")
+	flag.IntVar(&snapshotInterval, "snapshot", 100, "Turns between the nodes sending their whole slice to the broker")
+	flag.IntVar(&rebalanceInterval, "rebalance", 100, "Turns between moving rows from slower nodes to faster ones and games onto their share of the nodes, 0 turns rebalancing off")
+	flag.IntVar(&checkpointInterval, "checkpoint", 0, "Turns between checkpoints saved to disk, 0 turns checkpointing off")
+	flag.StringVar(&checkpointDir, "checkpointDir", "checkpoints", "Directory the checkpoints are saved in, a directory in it for each game")
+	flag.DurationVar(&abandonTimeout, "abandon", 10*time.Second, "How long a game keeps running after its controller goes away without detaching, 0 keeps it running")
 	flag.Parse()
+	if checkpointInterval > 0 && checkpointInterval < snapshotInterval {
+		snapshotInterval = checkpointInterval // checkpoints are built from the snapshots
+	}
+	// slices of a broker that died may still be on the nodes, so never reuse their ids
+	nextSliceID = int(time.Now().UnixNano())
+	// game ids go on from the checkpoints on disk, so a resumed game never shares a directory with an old one
+	nextGameID = lastCheckpointedGame()
 	rpc.Register(&GameOfLifeOperation{})
-	listener, _ := net.Listen("tcp", ":"+*pAddr)
+	listener, err := net.Listen("tcp", ":"+*pAddr)
+	util.Check(err)
+	if streamPort == "" {
+		port, err := strconv.Atoi(*pAddr)
+		util.Check(err)
+		streamPort = strconv.Itoa(port + 1)
+	}
+	streams, err := net.Listen("tcp", ":"+streamPort)
+	util.Check(err)
+	go serveStreams(streams)
 
-	defer func(listener net.Listener) {
-		err := listener.Close()
-		if err != nil {
-			fmt.Println("Error in listerner")
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go rpc.ServeConn(conn)
 		}
-	}(listener)
-
-	rpc.Accept(listener)
+	}()
 
+	code := <-shutdown
+	streams.Close()
+	err = listener.Close()
+	if err != nil {
+		fmt.Println("Error in listerner")
+	}
+	// give the replies to Shutdown and CompleteTurn time to reach the client
+	time.Sleep(shutdownGrace)
+	os.Exit(code)
 }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"uk.ac.bris.cs/gameoflife/stubs"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+var streamPort string
+
+// streamBuffer is how many messages a subscriber can fall behind by before the game waits for it, or for an
+// observer, before messages are dropped
+const streamBuffer = 64
+
+// aliveInterval is how often the alive cell count is pushed to the subscribers
+const aliveInterval = 2 * time.Second
+
+// errClientGone is returned by serve when the client closes its end of the stream without detaching
+var errClientGone = errors.New("the client went away")
+
+// subscriber is a stream the broker pushes a game down. One taking every turn is sent each turn through messages
+// and the game waits for it when that is full. A sampled one is not waited for, the cells flipped since its last frame
+// are gathered in changed and sent frameRate times a second. Everything else goes through messages either way.
+// The game never waits for an observer, whatever does not fit is dropped and it is caught up once there is room,
+// behind says it has missed turns and missedState is the last pause or resume it missed.
+type subscriber struct {
+	game        *game
+	messages    chan stubs.StreamMessage
+	done        <-chan bool
+	frameRate   int
+	changed     util.BitBoard
+	pending     bool
+	lastTurn    int
+	observer    bool
+	behind      bool
+	missedState *stubs.StreamMessage
+}
+
+// Makes a subscriber for a controller or observer and adds it to the ones the game is published to, its stream
+// connects later
+func (g *game) newSubscriber(width, height, frameRate int, observer bool, done <-chan bool) *subscriber {
+	sub := &subscriber{game: g, messages: make(chan stubs.StreamMessage, streamBuffer), done: done, frameRate: frameRate, lastTurn: g.turn, observer: observer}
+	if frameRate > 0 {
+		sub.changed = util.NewBitBoard(width, height)
+	}
+	g.subscribers = append(g.subscribers, sub)
+	return sub
+}
+
+func (g *game) removeSubscriber(sub *subscriber) {
+	for i, s := range g.subscribers {
+		if s == sub {
+			g.subscribers = append(g.subscribers[:i], g.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Sends a message to a subscriber, waiting if it is too far behind unless it goes away. Observers are never waited
+// for. Called without g.mutex held.
+func (sub *subscriber) send(message stubs.StreamMessage) {
+	if sub.observer {
+		sub.offer(message)
+		return
+	}
+	select {
+	case sub.messages <- message:
+	case <-sub.done:
+	}
+}
+
+// Queues a message for an observer if there is room. Once there is room again after turns were dropped the
+// observer is sent the whole world instead, then any pause or resume it missed.
+func (sub *subscriber) offer(message stubs.StreamMessage) {
+	g := sub.game
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if sub.behind {
+		if !sub.tryQueue(stubs.StreamMessage{Kind: stubs.TurnMessage, Turn: g.turn, World: g.world.Copy()}) {
+			return
+		}
+		sub.behind = false
+		if message.Kind == stubs.TurnMessage {
+			// the world has the turn's cells already
+			return
+		}
+	}
+	if sub.missedState != nil && message.Kind != stubs.StateMessage {
+		if !sub.tryQueue(*sub.missedState) {
+			return
+		}
+		sub.missedState = nil
+	}
+	if sub.tryQueue(message) {
+		if message.Kind == stubs.StateMessage {
+			sub.missedState = nil
+		}
+		return
+	}
+	switch message.Kind {
+	case stubs.TurnMessage:
+		sub.behind = true
+	case stubs.StateMessage:
+		sub.missedState = &message
+	}
+}
+
+func (sub *subscriber) tryQueue(message stubs.StreamMessage) bool {
+	select {
+	case sub.messages <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sends a message to every subscriber of the game
+func (g *game) publish(message stubs.StreamMessage) {
+	g.mutex.Lock()
+	subs := append([]*subscriber(nil), g.subscribers...)
+	g.mutex.Unlock()
+	for _, sub := range subs {
+		sub.send(message)
+	}
+}
+
+// Gathers flipped cells into the sampled subscribers' next frames and returns the subscribers taking every turn,
+// which the cells still have to be sent to once g.mutex is unlocked. Called with g.mutex locked.
+func (g *game) gatherFlipped(turn int, flipped []util.Cell) []*subscriber {
+	var everyTurn []*subscriber
+	for _, sub := range g.subscribers {
+		if sub.frameRate == 0 {
+			everyTurn = append(everyTurn, sub)
+			continue
+		}
+		for _, cell := range flipped {
+			sub.changed.Flip(cell.X, cell.Y)
+		}
+		sub.pending = true
+		sub.lastTurn = turn
+	}
+	return everyTurn
+}
+
+// Takes the cells flipped since a sampled subscriber's last frame. Each cell takes a few bytes as a flipped cell
+// but the whole world is only a bit a cell, so when enough have flipped the world is sent instead.
+func (sub *subscriber) frame() (stubs.StreamMessage, bool) {
+	sub.game.mutex.Lock()
+	defer sub.game.mutex.Unlock()
+	if !sub.pending {
+		return stubs.StreamMessage{}, false
+	}
+	message := stubs.StreamMessage{Kind: stubs.TurnMessage, Turn: sub.lastTurn}
+	if sub.changed.Count() > len(sub.changed.Words) {
+		message.World = sub.game.world.Copy()
+	} else {
+		message.FlippedCells = sub.changed.AliveCells(0)
+	}
+	for i := range sub.changed.Words {
+		sub.changed.Words[i] = 0
+	}
+	sub.pending = false
+	return message, true
+}
+
+// Takes the whole world for an observer that has missed turns, so it still ends up on the game's last turn
+func (sub *subscriber) catchUp() (stubs.StreamMessage, bool) {
+	sub.game.mutex.Lock()
+	defer sub.game.mutex.Unlock()
+	if !sub.behind {
+		return stubs.StreamMessage{}, false
+	}
+	sub.behind = false
+	return stubs.StreamMessage{Kind: stubs.TurnMessage, Turn: sub.game.turn, World: sub.game.world.Copy()}, true
+}
+
+// Writes a subscriber's messages to its stream until it goes away, or until lost is closed by the client closing
+// its end. What is still queued by then is sent before the stream is closed, which is how the end of a finished
+// game gets through.
+func (sub *subscriber) serve(conn net.Conn, lost <-chan bool) error {
+	writer := bufio.NewWriter(conn)
+	encoder := gob.NewEncoder(writer)
+	write := func(message stubs.StreamMessage) error {
+		if err := encoder.Encode(message); err != nil {
+			return err
+		}
+		return writer.Flush()
+	}
+	// the controller waits for this before starting a game, so it cannot miss the first turns
+	if err := write(stubs.StreamMessage{Kind: stubs.SubscribedMessage}); err != nil {
+		return err
+	}
+
+	var frames <-chan time.Time
+	if sub.frameRate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(sub.frameRate))
+		defer ticker.Stop()
+		frames = ticker.C
+	}
+	for {
+		select {
+		case message := <-sub.messages:
+			if err := write(message); err != nil {
+				return err
+			}
+		case <-frames:
+			if message, ok := sub.frame(); ok {
+				if err := write(message); err != nil {
+					return err
+				}
+			}
+		case <-lost:
+			return errClientGone
+		case <-sub.done:
+			for len(sub.messages) > 0 {
+				if err := write(<-sub.messages); err != nil {
+					return err
+				}
+			}
+			if message, ok := sub.frame(); ok {
+				return write(message)
+			}
+			if message, ok := sub.catchUp(); ok {
+				return write(message)
+			}
+			return nil
+		}
+	}
+}
+
+// Hands a stream connection to the subscriber of the controller or observer it names
+func acceptStream(conn net.Conn) {
+	defer conn.Close()
+	var req stubs.StreamRequest
+	if err := gob.NewDecoder(conn).Decode(&req); err != nil {
+		fmt.Println("Could not read stream request:", err)
+		return
+	}
+	g, err := findGame(req.Game)
+	if err != nil {
+		fmt.Println("Stream request for a game that is not on the broker:", err)
+		return
+	}
+	g.mutex.Lock()
+	watching := g.attached
+	if watching == nil || watching.id != req.Controller {
+		watching = g.observers[req.Controller]
+	}
+	g.mutex.Unlock()
+	if watching == nil {
+		fmt.Println("Stream request from a client that is not attached")
+		return
+	}
+	// the client never writes after its request, so reading only returns once it has closed the stream
+	lost := make(chan bool)
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(lost)
+	}()
+	err = watching.sub.serve(conn, lost)
+	g.mutex.Lock()
+	g.removeSubscriber(watching.sub)
+	if err != nil {
+		// a client that detached has been let go already, one whose stream broke has not
+		g.lostClient(watching)
+	}
+	g.mutex.Unlock()
+	if err != nil {
+		fmt.Println("Stream to a client closed:", err)
+	}
+}
+
+func serveStreams(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go acceptStream(conn)
+	}
+}
+
+// Pushes the game's alive cell count to every subscriber until stop is closed
+func (g *game) publishAlive(stop <-chan bool) {
+	ticker := time.NewTicker(aliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		g.mutex.Lock()
+		message := stubs.StreamMessage{Kind: stubs.AliveMessage, Turn: g.turn, Alive: g.alive}
+		g.mutex.Unlock()
+		g.publish(message)
+	}
+}
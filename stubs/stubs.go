@@ -1,37 +1,58 @@
 package stubs
 
-import "uk.ac.bris.cs/gameoflife/util"
+import (
+	"time"
+
+	"uk.ac.bris.cs/gameoflife/util"
+)
 
 var TurnHandler = "GameOfLifeOperation.CompleteTurn"
 var AliveCellGetter = "GameOfLifeOperation.AliveCellGetter"
 var Shutdown = "GameOfLifeOperation.Shutdown"
-var Reset = "GameOfLifeOperation.ResetState"
+var Attach = "GameOfLifeOperation.Attach"
+var Detach = "GameOfLifeOperation.Detach"
 var PauseAndResume = "GameOfLifeOperation.PauseAndResume"
 var PauseAndResumeNode = "Node.PauseAndResumeNode"
-var GetWorldPerTurn = "GameOfLifeOperation.GetWorldPerTurn"
 var ProcessSlice = "Node.ProcessSlice"
-var GetFlippedCells = "Node.GetFlippedCells"
 var GetWorld = "GameOfLifeOperation.GetWorld"
-var GetNode = "Node.GetNode"
-var GetTurnAndAliveCell = "Node.GetTurnAndAliveCell"
-var SendHaloToBroker = "Node.SendHaloToBroker"
+var GetTurnReport = "Node.GetTurnReport"
 var SendHaloToNode = "Node.SendHaloToNode"
+var Heartbeat = "Node.Heartbeat"
+var StopSlice = "Node.StopSlice"
+var ResizeSlice = "Node.ResizeSlice"
+var ShutdownNode = "Node.Shutdown"
+var Redirect = "Node.Redirect"
+var RegisterWorker = "GameOfLifeOperation.RegisterWorker"
+var GetCheckpoint = "GameOfLifeOperation.GetCheckpoint"
+var EditCells = "GameOfLifeOperation.EditCells"
+var EditCellsNode = "Node.EditCells"
 
 type Request struct {
+	Game         int
+	Controller   int
 	Turns        int
 	Threads      int
 	ImageWidth   int
 	ImageHeight  int
+	Rule         string
+	Boundary     string
 	GameStatus   string
-	InitialWorld [][]uint8
-	Workers      []string
+	InitialWorld util.BitBoard
 }
 
 type Response struct {
-	World [][]uint8
+	Game  int
+	Turn  int
+	World util.BitBoard
 }
 
 type TurnRequest struct {
+	Game int
+}
+
+// GameRequest names one of the games running on the broker by the id Attach gave it.
+type GameRequest struct {
+	Game int
 }
 
 type TurnResponse struct {
@@ -39,17 +60,85 @@ type TurnResponse struct {
 	NumOfAliveCells int
 }
 
-type SdlResponse struct {
-	Turn         int
-	FlippedCells []util.Cell
+// Kinds of StreamMessage, SUBSCRIBED is the first down a stream once the broker has connected it to the game
+const (
+	SubscribedMessage = "SUBSCRIBED"
+	TurnMessage       = "TURN"
+	AliveMessage      = "ALIVE"
+	StateMessage      = "STATE"
+)
+
+// StreamRequest is the first thing a client sends down a stream connection, naming the game and the controller
+// or observer it is for by the ids Attach gave it.
+type StreamRequest struct {
+	Game       int
+	Controller int
 }
 
-type FlippedCellResponse struct {
+// StreamMessage is what the broker pushes down a stream, one gob value at a time.
+// A TURN has the cells that flipped up to Turn, or the whole World when sending that is smaller.
+// An ALIVE has the number of Alive cells at Turn, and a STATE says the game is Paused at Turn or carrying on.
+type StreamMessage struct {
+	Kind         string
+	Turn         int
 	FlippedCells []util.Cell
+	World        util.BitBoard
+	Alive        int
+	Paused       bool
 }
 
+// PauseRequest is "PAUSE", "RESUME" or "STEP" from the controller to the broker. Nodes get "RUNTO" instead of "STEP".
 type PauseRequest struct {
-	Command string
+	Game       int
+	Controller int
+	Command    string
+	Turns      int // for STEP, how many turns to run
+	Turn       int // for RUNTO, the last turn to run
+}
+
+// CellsRequest has cells for the broker to flip in the paused game.
+type CellsRequest struct {
+	Game       int
+	Controller int
+	Cells      []util.Cell
+}
+
+// EditRequest has cells for a node to flip in one of its slices, with y counted from the top of the slice.
+type EditRequest struct {
+	Slice int
+	Turn  int
+	Cells []util.Cell
+}
+
+// ResizeRequest moves the edges of a slice held on Turn to StartY and EndY. Top and Bottom are the rows it takes
+// from its neighbours above and below, rows it gives them are dropped.
+type ResizeRequest struct {
+	Slice  int
+	Turn   int
+	StartY int
+	EndY   int
+	Top    util.BitBoard
+	Bottom util.BitBoard
+}
+
+// Kept returns the rows a slice holding startY to endY keeps when it moves, Top and Bottom hold the rest.
+// A slice that moves clear of its rows keeps none of them and is sent all its new rows in Top.
+func (r ResizeRequest) Kept(startY, endY int) (int, int) {
+	if r.StartY > startY {
+		startY = r.StartY
+	}
+	if r.EndY < endY {
+		endY = r.EndY
+	}
+	if startY >= endY {
+		return r.EndY, r.EndY
+	}
+	return startY, endY
+}
+
+// PauseResponse has the turn the game is paused on, or will be once the nodes have caught up to it.
+type PauseResponse struct {
+	Turn int
 }
 
 type EmptyRequest struct {
@@ -58,34 +147,133 @@ type EmptyRequest struct {
 type EmptyResponse struct {
 }
 
-type ResetRequest struct {
-	LengthOfWorld int
+type RegisterRequest struct {
+	Address string
 }
 
-type ResetResponse struct {
+// Neighbour is where the slice above or below lives, nodes send their edge rows straight to it
+type Neighbour struct {
+	Address string
+	Slice   int
 }
 
+// NodeRequest starts a slice on a node. CurrentWorld is the slice at StartTurn, FromAbove and FromBelow
+// hold the neighbours' edge rows from StartTurn on; a replacement node replays them before waiting on its neighbours.
+// Turns before ReportFrom have already been reported by a previous node so are not reported again.
 type NodeRequest struct {
-	Turns        int
-	StartY       int
-	EndY         int
-	Width        int
-	CurrentWorld [][]uint8
+	Game             int
+	Slice            int
+	Turns            int
+	Threads          int
+	Rule             string
+	Boundary         string
+	ImageHeight      int
+	StartTurn        int
+	ReportFrom       int
+	SnapshotInterval int
+	StartY           int
+	EndY             int
+	Up               Neighbour
+	Down             Neighbour
+	CurrentWorld     util.BitBoard
+	FromAbove        [][]uint64
+	FromBelow        [][]uint64
 }
 
 type NodeResponse struct {
-	WorldSlice [][]uint8
+	WorldSlice util.BitBoard
 }
 
 type WorldResponse struct {
-	World [][]uint8
+	World util.BitBoard
+}
+
+// CheckpointRequest asks for the newest checkpoint of a world this size.
+type CheckpointRequest struct {
+	ImageWidth  int
+	ImageHeight int
+}
+
+type CheckpointResponse struct {
+	Turn        int
+	ImageWidth  int
+	ImageHeight int
+	Rule        string
+	Boundary    string
+	World       util.BitBoard
+}
+
+// AttachRequest makes the caller the controller of a game, or with Observer set one of any number of observers of
+// a running game who can watch it but not change it. Game picks the game, without it the broker picks a running
+// game of this size, or for a controller starts a new one when none is waiting for a controller.
+// With FrameRate set the broker does not wait for the caller to take each turn, it sends a TURN with the cells
+// flipped since the last one FrameRate times a second instead.
+type AttachRequest struct {
+	Game        int
+	ImageWidth  int
+	ImageHeight int
+	FrameRate   int
+	Observer    bool
+}
+
+// MaxFrameRate is the most frames a second an AttachRequest can ask for.
+const MaxFrameRate = 1000
+
+// AttachResponse says where the game is. Stream is the port the broker takes stream connections on.
+type AttachResponse struct {
+	Game       int
+	Controller int
+	Stream     string
+	Running    bool
+	Paused     bool
+	Turn       int
+	Turns      int
+	World      util.BitBoard
+}
+
+type ControllerRequest struct {
+	Game       int
+	Controller int
 }
 
 type AliveCellCountResponse struct {
 	Count int
 }
 
-type HaloResponse struct {
-	FirstHalo []uint8
-	LastHalo  []uint8
+// HaloRequest carries an edge row of a slice after a turn to the slice next to it
+type HaloRequest struct {
+	Slice     int
+	Turn      int
+	FromAbove bool
+	Halo      []uint64
+}
+
+// RedirectRequest points a slice's neighbour above (Up) or below at the node that took over from a dead one
+type RedirectRequest struct {
+	Slice     int
+	Up        bool
+	Neighbour Neighbour
+	From      int
+}
+
+// RedirectResponse holds the edge rows the slice has sent that neighbour from the requested turn on
+type RedirectResponse struct {
+	Halos [][]uint64
+}
+
+// SliceRequest names a slice on a node. Edge rows from before KeepFrom are no longer needed for a replacement.
+type SliceRequest struct {
+	Slice    int
+	KeepFrom int
+}
+
+// TurnReport is what a node hands the broker after finishing a turn of a slice.
+// WorldSlice is only set on snapshot turns and the final turn. Busy is how long the node spent working the turn
+// out, not counting the time it waited for halos.
+type TurnReport struct {
+	Turn            int
+	NumOfAliveCells int
+	FlippedCells    []util.Cell
+	WorldSlice      util.BitBoard
+	Busy            time.Duration
 }
@@ -0,0 +1,104 @@
+package util
+
+import "math/bits"
+
+// BitBoard is a world, or a band of rows of one, packed one bit per cell and 64 cells to a word.
+// Cell x of a row is bit x%64 of word x/64, and every row starts on a new word so rows can be
+// sliced out and sent on their own. Bits past the width are always 0.
+type BitBoard struct {
+	Width  int
+	Height int
+	Words  []uint64
+}
+
+// RowWords is how many words a row of the given width takes up.
+func RowWords(width int) int {
+	return (width + 63) / 64
+}
+
+// LastWordMask has the bits of the last word of a row that hold cells.
+func LastWordMask(width int) uint64 {
+	if width%64 == 0 {
+		return ^uint64(0)
+	}
+	return uint64(1)<<uint(width%64) - 1
+}
+
+func NewBitBoard(width, height int) BitBoard {
+	return BitBoard{Width: width, Height: height, Words: make([]uint64, RowWords(width)*height)}
+}
+
+// Row returns the words of row y, sharing them with the board.
+func (b BitBoard) Row(y int) []uint64 {
+	rowWords := RowWords(b.Width)
+	return b.Words[y*rowWords : (y+1)*rowWords]
+}
+
+// Rows returns rows startY to endY as a board of their own, sharing them with the board.
+func (b BitBoard) Rows(startY, endY int) BitBoard {
+	rowWords := RowWords(b.Width)
+	return BitBoard{Width: b.Width, Height: endY - startY, Words: b.Words[startY*rowWords : endY*rowWords]}
+}
+
+func (b BitBoard) Alive(x, y int) bool {
+	return b.Words[y*RowWords(b.Width)+x/64]>>uint(x%64)&1 == 1
+}
+
+func (b BitBoard) Set(x, y int, alive bool) {
+	word := &b.Words[y*RowWords(b.Width)+x/64]
+	if alive {
+		*word |= 1 << uint(x%64)
+	} else {
+		*word &^= 1 << uint(x%64)
+	}
+}
+
+func (b BitBoard) Flip(x, y int) {
+	b.Words[y*RowWords(b.Width)+x/64] ^= 1 << uint(x%64)
+}
+
+// Count returns the number of alive cells.
+func (b BitBoard) Count() int {
+	count := 0
+	for _, word := range b.Words {
+		count += bits.OnesCount64(word)
+	}
+	return count
+}
+
+// AliveCells returns the alive cells, offsetting their y by startY.
+func (b BitBoard) AliveCells(startY int) []Cell {
+	return b.Diff(BitBoard{Width: b.Width, Height: b.Height, Words: make([]uint64, len(b.Words))}, startY)
+}
+
+// Diff returns the cells that differ between two boards of the same size, offsetting their y by startY.
+func (b BitBoard) Diff(other BitBoard, startY int) []Cell {
+	var cells []Cell
+	rowWords := RowWords(b.Width)
+	for i, word := range b.Words {
+		diff := word ^ other.Words[i]
+		for diff != 0 {
+			bit := bits.TrailingZeros64(diff)
+			cells = append(cells, Cell{X: i%rowWords*64 + bit, Y: startY + i/rowWords})
+			diff &= diff - 1
+		}
+	}
+	return cells
+}
+
+func (b BitBoard) Copy() BitBoard {
+	words := make([]uint64, len(b.Words))
+	copy(words, b.Words)
+	return BitBoard{Width: b.Width, Height: b.Height, Words: words}
+}
+
+// JoinBitBoards stacks bands of rows of the same width on top of each other.
+func JoinBitBoards(bands []BitBoard) BitBoard {
+	var joined BitBoard
+	for _, band := range bands {
+		joined.Width = band.Width
+		joined.Height += band.Height
+		joined.Words = append(joined.Words, band.Words...)
+	}
+	return joined
+}
@@ -0,0 +1,99 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLastWordMask(t *testing.T) {
+	tests := []struct {
+		width int
+		mask  uint64
+	}{
+		{1, 0x1},
+		{63, 0x7FFFFFFFFFFFFFFF},
+		{64, 0xFFFFFFFFFFFFFFFF},
+		{100, 0xFFFFFFFFF},
+		{129, 0x1},
+	}
+	for _, test := range tests {
+		if mask := LastWordMask(test.width); mask != test.mask {
+			t.Errorf("LastWordMask(%d) = %x, want %x", test.width, mask, test.mask)
+		}
+	}
+}
+
+// stripes has every third cell alive, counting along the rows
+func stripes(width, height int) BitBoard {
+	board := NewBitBoard(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			board.Set(x, y, (y*width+x)%3 == 0)
+		}
+	}
+	return board
+}
+
+func TestRows(t *testing.T) {
+	for _, width := range []int{64, 100, 129} {
+		t.Run(fmt.Sprint(width), func(t *testing.T) {
+			board := stripes(width, 10)
+			rows := board.Rows(3, 7)
+			if rows.Width != width || rows.Height != 4 || len(rows.Words) != 4*RowWords(width) {
+				t.Fatalf("Rows(3, 7) is %dx%d with %d words", rows.Width, rows.Height, len(rows.Words))
+			}
+			for y := 0; y < 4; y++ {
+				for x := 0; x < width; x++ {
+					if rows.Alive(x, y) != board.Alive(x, y+3) {
+						t.Fatalf("cell %d,%d of the rows is not cell %d,%d of the board", x, y, x, y+3)
+					}
+				}
+			}
+			// the rows share their words with the board
+			rows.Flip(width-1, 0)
+			if rows.Alive(width-1, 0) != board.Alive(width-1, 3) {
+				t.Errorf("flipping a cell of the rows did not flip it on the board")
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	for _, width := range []int{64, 100, 129} {
+		t.Run(fmt.Sprint(width), func(t *testing.T) {
+			board := stripes(width, 5)
+			other := board.Copy()
+			flipped := []Cell{{0, 0}, {width - 1, 0}, {63, 2}, {width / 2, 4}}
+			for _, cell := range flipped {
+				other.Flip(cell.X, cell.Y)
+			}
+			diff := board.Diff(other, 10)
+			if len(diff) != len(flipped) {
+				t.Fatalf("Diff found %d cells, want %d", len(diff), len(flipped))
+			}
+			for i, cell := range flipped {
+				if want := (Cell{cell.X, cell.Y + 10}); diff[i] != want {
+					t.Errorf("cell %d of the diff is %v, want %v", i, diff[i], want)
+				}
+			}
+			if cells := board.AliveCells(0); len(cells) != board.Count() {
+				t.Errorf("AliveCells found %d cells, Count %d", len(cells), board.Count())
+			}
+		})
+	}
+}
+
+func TestJoinBitBoards(t *testing.T) {
+	for _, width := range []int{64, 100, 129} {
+		t.Run(fmt.Sprint(width), func(t *testing.T) {
+			board := stripes(width, 9)
+			joined := JoinBitBoards([]BitBoard{board.Rows(0, 1), board.Rows(1, 5), board.Rows(5, 9)})
+			if joined.Width != width || joined.Height != 9 {
+				t.Fatalf("joined board is %dx%d, want %dx9", joined.Width, joined.Height, width)
+			}
+			if diff := joined.Diff(board, 0); len(diff) > 0 {
+				t.Errorf("%d cells differ after joining the bands, the first is %v", len(diff), diff[0])
+			}
+		})
+	}
+}
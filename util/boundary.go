@@ -0,0 +1,19 @@
+package util
+
+import "fmt"
+
+// Boundary modes, what a cell on the edge of the world sees past it.
+const (
+	Torus = "torus" // the edges wrap round to the opposite edge
+	Dead  = "dead"  // cells past the edges are always dead
+	Klein = "klein" // left and right wrap, top and bottom wrap with the row mirrored
+)
+
+// CheckBoundary returns an error unless the boundary is one of the modes above.
+func CheckBoundary(boundary string) error {
+	switch boundary {
+	case Torus, Dead, Klein:
+		return nil
+	}
+	return fmt.Errorf("boundary %q is not one of %s, %s or %s", boundary, Torus, Dead, Klein)
+}
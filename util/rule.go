@@ -0,0 +1,46 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultRule is Conway's Game of Life.
+const DefaultRule = "B3/S23"
+
+// Rule is a Life-like rule in bit form: bit n of Birth is set if a dead cell with n alive
+// neighbours comes alive, and bit n of Survive if an alive cell with n alive neighbours stays alive.
+type Rule struct {
+	Birth   uint16
+	Survive uint16
+}
+
+// ParseRule reads a rule in B/S notation, e.g. "B36/S23" for HighLife or "B2/S" for Seeds.
+// The letters are case insensitive and the two parts can come in either order.
+func ParseRule(rule string) (Rule, error) {
+	var r Rule
+	parts := strings.Split(strings.ToUpper(strings.TrimSpace(rule)), "/")
+	if len(parts) != 2 {
+		return r, fmt.Errorf("rule %q is not in B/S notation, e.g. %s", rule, DefaultRule)
+	}
+	seen := make(map[byte]bool)
+	for _, part := range parts {
+		if part == "" || (part[0] != 'B' && part[0] != 'S') || seen[part[0]] {
+			return r, fmt.Errorf("rule %q needs one B part and one S part, e.g. %s", rule, DefaultRule)
+		}
+		seen[part[0]] = true
+		var counts uint16
+		for _, digit := range part[1:] {
+			if digit < '0' || digit > '8' {
+				return r, fmt.Errorf("rule %q has %q as a neighbour count, counts go from 0 to 8", rule, digit)
+			}
+			counts |= 1 << uint(digit-'0')
+		}
+		if part[0] == 'B' {
+			r.Birth = counts
+		} else {
+			r.Survive = counts
+		}
+	}
+	return r, nil
+}
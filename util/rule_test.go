@@ -0,0 +1,40 @@
+package util
+
+import "testing"
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		birth   uint16
+		survive uint16
+	}{
+		{"B3/S23", 1 << 3, 1<<2 | 1<<3},
+		{"B36/S23", 1<<3 | 1<<6, 1<<2 | 1<<3},
+		{"B2/S", 1 << 2, 0},
+		{"B/S", 0, 0},
+		{"B0/S8", 1, 1 << 8},
+		{"b3/s23", 1 << 3, 1<<2 | 1<<3},
+		{"S23/B3", 1 << 3, 1<<2 | 1<<3},
+		{" B3/S23 ", 1 << 3, 1<<2 | 1<<3},
+		{"B012345678/S012345678", 0x1FF, 0x1FF},
+	}
+	for _, test := range tests {
+		t.Run(test.rule, func(t *testing.T) {
+			r, err := ParseRule(test.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Birth != test.birth || r.Survive != test.survive {
+				t.Errorf("got B%09b/S%09b, want B%09b/S%09b", r.Birth, r.Survive, test.birth, test.survive)
+			}
+		})
+	}
+
+	for _, rule := range []string{"", "B3", "B3/S23/S1", "B3/B23", "S3/S23", "3/S23", "B3/", "B9/S23", "B3/S2x"} {
+		t.Run("invalid "+rule, func(t *testing.T) {
+			if _, err := ParseRule(rule); err == nil {
+				t.Errorf("ParseRule(%q) did not fail", rule)
+			}
+		})
+	}
+}